@@ -0,0 +1,148 @@
+//go:build !wasm
+
+package sse
+
+import "net/http"
+
+// PublishWithAck works like Publish but tracks the message per targeted
+// client until it is acknowledged with Ack (or AckHandler). Unacked
+// messages are re-sent when a client reconnects with the same ID, so
+// delivery is at-least-once. Client IDs must be stable across reconnects
+// for that (see ServerConfig.GenerateClientID and AcceptClientID); with
+// the default random IDs, tracking ends when the connection closes.
+func (s *SSEServer) PublishWithAck(data []byte, channels ...string) {
+	s.hub.broadcast <- &broadcastMessage{
+		msg: &SSEMessage{
+			Data: data,
+		},
+		target: Target{Channels: channels},
+		ack:    true,
+	}
+}
+
+// Ack acknowledges every tracked message up to and including messageID
+// for a client. IDs increase monotonically, so one ack covers all earlier
+// messages.
+func (s *SSEServer) Ack(clientID, messageID string) {
+	upTo := s.hub.seqOf(messageID)
+	s.hub.do(func() {
+		pending := s.hub.unacked[clientID]
+		kept := pending[:0]
+		for _, msg := range pending {
+			if s.hub.seqOf(msg.ID) > upTo {
+				kept = append(kept, msg)
+			}
+		}
+		if len(kept) == 0 {
+			delete(s.hub.unacked, clientID)
+		} else {
+			s.hub.unacked[clientID] = kept
+		}
+	})
+}
+
+// UnackedCount returns how many PublishWithAck messages a client has not
+// acknowledged yet.
+func (s *SSEServer) UnackedCount(clientID string) int {
+	var n int
+	s.hub.do(func() {
+		n = len(s.hub.unacked[clientID])
+	})
+	return n
+}
+
+// AckHandler returns the endpoint clients POST acknowledgements to, with
+// "client" and "id" query params (see ClientConfig.AckEndpoint). Wrap it
+// with your own auth if client IDs are guessable.
+func (s *SSEServer) AckHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.handleCORS(w, r, http.MethodPost) {
+			return
+		}
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		clientID, messageID := r.URL.Query().Get("client"), r.URL.Query().Get("id")
+		if clientID == "" || messageID == "" {
+			http.Error(w, "client and id are required", http.StatusBadRequest)
+			return
+		}
+		s.Ack(clientID, messageID)
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// trackUnacked records an ack-required message for a client, keeping at
+// most MaxUnacked (oldest dropped).
+func (h *hub) trackUnacked(client *clientConnection, msg *SSEMessage) {
+	pending := append(h.unacked[client.id], msg)
+	if over := len(pending) - h.config.MaxUnacked; over > 0 {
+		pending = pending[over:]
+	}
+	h.unacked[client.id] = pending
+}
+
+// resendUnacked returns the frames of the messages a reconnecting client
+// never acknowledged, and their IDs, so history replay skips them.
+func (h *hub) resendUnacked(client *clientConnection) (frames [][]byte, resent map[string]bool) {
+	pending := h.unacked[client.id]
+	if len(pending) == 0 {
+		return nil, nil
+	}
+	resent = make(map[string]bool, len(pending))
+	for _, msg := range pending {
+		if data, ok := h.render(client, msg); ok {
+			frames = append(frames, data)
+		}
+		resent[msg.ID] = true
+	}
+	return frames, resent
+}
+
+// forgetUnacked drops the tracked messages of a removed client unless it
+// may come back with the same ID (GenerateClientID or AcceptClientID).
+func (h *hub) forgetUnacked(client *clientConnection, reason DisconnectReason) {
+	reusable := h.config.GenerateClientID != nil || h.config.AcceptClientID
+	if !reusable || reason == ReasonDisconnected || reason == ReasonAuthRevoked {
+		delete(h.unacked, client.id)
+		return
+	}
+	if _, ok := h.unacked[client.id]; !ok {
+		return
+	}
+
+	// Clients that never come back must not be tracked forever: keep the
+	// MaxUnacked most recently departed
+	for i, id := range h.departed {
+		if id == client.id {
+			h.departed = append(h.departed[:i], h.departed[i+1:]...)
+			break
+		}
+	}
+	h.departed = append(h.departed, client.id)
+	if over := len(h.departed) - h.config.MaxUnacked; over > 0 {
+		for _, id := range h.departed[:over] {
+			if _, connected := h.clients[id]; !connected {
+				delete(h.unacked, id)
+			}
+		}
+		h.departed = h.departed[over:]
+	}
+}
+
+// pruneUnacked drops the tracked messages older than oldest, the first
+// sequence left in history: once trimmed, they are lost to replay too.
+func (h *hub) pruneUnacked(oldest int) {
+	for id, pending := range h.unacked {
+		n := 0
+		for n < len(pending) && h.seqOf(pending[n].ID) < oldest {
+			n++
+		}
+		if n == len(pending) {
+			delete(h.unacked, id)
+		} else if n > 0 {
+			h.unacked[id] = pending[n:]
+		}
+	}
+}
@@ -0,0 +1,60 @@
+//go:build !wasm
+
+package sse
+
+import (
+	"bytes"
+	"time"
+
+	. "github.com/tinywasm/fmt"
+)
+
+// pendingBatch collects PublishBatched items for one set of channels.
+type pendingBatch struct {
+	channels []string
+	items    [][]byte
+}
+
+// PublishBatched coalesces high-frequency updates (tickers, telemetry): items
+// published for the same channels within window are sent as a single
+// BatchEvent message, one item per data line, when the window closes.
+// Items containing a newline would split on the client, so they are logged
+// and dropped. Read them with SSEMessage.BatchItems.
+func (s *SSEServer) PublishBatched(data []byte, window time.Duration, channels ...string) {
+	if bytes.ContainsAny(data, "\r\n") {
+		s.tinySSE.warn("SSE PublishBatched item dropped: it contains a newline")
+		return
+	}
+	key := batchKey(channels)
+	s.hub.do(func() {
+		b, ok := s.hub.batches[key]
+		if !ok {
+			b = &pendingBatch{channels: channels}
+			s.hub.batches[key] = b
+			time.AfterFunc(window, func() { s.flushBatch(key) })
+		}
+		b.items = append(b.items, data)
+	})
+}
+
+// batchKey identifies a set of channels. Names are length-prefixed: any
+// separator could also appear in a channel name.
+func batchKey(channels []string) string {
+	b := Convert()
+	for _, ch := range channels {
+		b.Write(Convert(len(ch)).String())
+		b.Write(":")
+		b.Write(ch)
+	}
+	return b.String()
+}
+
+// flushBatch publishes the items collected for key as one message.
+func (s *SSEServer) flushBatch(key string) {
+	var b *pendingBatch
+	s.hub.do(func() {
+		b = s.hub.batches[key]
+		delete(s.hub.batches, key)
+	})
+	s.PublishEvent(BatchEvent, bytes.Join(b.items, []byte("\n")), b.channels...)
+}
@@ -0,0 +1,34 @@
+//go:build !wasm
+
+package sse
+
+// BusMessage is a message shared between server instances by a BusAdapter.
+// All fields are exported so adapters can encode it (e.g., as JSON).
+type BusMessage struct {
+	Message SSEMessage
+	Target  Target
+	Key     string // PublishLatest key, if any
+	Origin  string // Node that published it, random per SSEServer
+}
+
+// noopBus is the default BusAdapter: messages stay on this node.
+type noopBus struct{}
+
+func (noopBus) Publish(msg BusMessage)            {}
+func (noopBus) Subscribe(fn func(msg BusMessage)) {}
+
+// receiveFromBus publishes a message from another node to the local
+// clients. It gets a local ID and is kept in local history for replay.
+func (h *hub) receiveFromBus(msg BusMessage) {
+	if msg.Origin == h.nodeID {
+		return
+	}
+	m := msg.Message
+	m.ID = ""
+	h.broadcast <- &broadcastMessage{
+		msg:    &m,
+		target: msg.Target,
+		key:    msg.Key,
+		remote: true,
+	}
+}
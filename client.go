@@ -3,151 +3,672 @@
 package sse
 
 import (
+	"encoding/base64"
 	"syscall/js"
+	"time"
 
 	"github.com/tinywasm/fmt"
 )
 
+// EventSource readyState values.
+const (
+	ReadyStateConnecting = 0
+	ReadyStateOpen       = 1
+	ReadyStateClosed     = 2
+)
+
+// ConnectionState is the connection status reported to OnStateChange.
+type ConnectionState int
+
+const (
+	StateConnecting   ConnectionState = iota // First connection in progress
+	StateOpen                                // Receiving messages
+	StateReconnecting                        // Lost, retrying (browser or manual backoff)
+	StateClosed                              // Closed by Close or after MaxReconnectAttempts
+)
+
+// String returns a short label for status UIs and logs.
+func (s ConnectionState) String() string {
+	switch s {
+	case StateConnecting:
+		return "connecting"
+	case StateOpen:
+		return "open"
+	case StateReconnecting:
+		return "reconnecting"
+	case StateClosed:
+		return "closed"
+	}
+	return "unknown"
+}
+
 // SSEClient is the SSE client for WASM.
 type SSEClient struct {
 	tinySSE           *tinySSE
 	config            *ClientConfig
 	handler           func(msg *SSEMessage)
 	errorHandler      func(err error)
+	openHandler       func()
+	stateHandler      func(state ConnectionState, attempt int)
+	state             ConnectionState
+	stateAttempt      int
+	eventHandlers     map[string]func(msg *SSEMessage)
 	es                js.Value
 	reconnectAttempts int
 	lastEventID       string
+	closed            bool               // Set by Close to stop pending reconnects
+	refreshTimer      js.Value           // setTimeout ID of the next token refresh
+	refresh           js.Func            // Reconnects with a fresh token
+	lastActivity      time.Time          // Last message or heartbeat, for HeartbeatTimeout
+	watchdogTimer     js.Value           // setTimeout ID of the next heartbeat check
+	watchdog          js.Func            // Reconnects when the stream went silent
+	heartbeat         js.Func            // HeartbeatEvent listener
+	onMessage         js.Func            // Dispatches unnamed events, see initCallbacks
+	onError           js.Func            // Reports the error, reconnecting if needed
+	onOpen            js.Func            // Resets the backoff once the stream opens
+	listeners         map[string]js.Func // Named event listeners, by event
+	retry             js.Func            // Manual reconnect timer callback
+	ackFailed         js.Func            // Shared catch handler for ack requests
+	offline           []func()           // Intents queued by SendWhenOnline while disconnected
+	early             []*SSEMessage      // Messages received before OnMessage, see maxEarlyMessages
+	opened            bool               // The stream opened at least once since Connect
+	polling           bool               // Fell back to LongPollEndpoint
 }
 
+// maxEarlyMessages caps the messages held for an OnMessage handler that
+// is registered after Connect; older ones are dropped first.
+const maxEarlyMessages = 32
+
 // Client creates a new SSEClient instance.
 func (t *tinySSE) Client(c *ClientConfig) *SSEClient {
+	if err := c.Validate(); err != nil {
+		t.error("SSE invalid client config:", err)
+	}
 	return &SSEClient{
 		tinySSE: t,
 		config:  c,
+		state:   StateClosed,
 	}
 }
 
 // Connect establishes a connection to the SSE endpoint.
 func (c *SSEClient) Connect() {
-	// 1. Construct URL with Last-Event-ID if available
-	// The browser automatically sends Last-Event-ID header on reconnection,
-	// but for our manual reconnections or initial connections we might want to append it?
-	// Actually, EventSource API doesn't allow setting headers.
-	// Browsers handle Last-Event-ID header automatically if the connection was dropped and browser retries.
-	// But if WE close and reopen (e.g. for token refresh, which we removed), we might need to pass it in query?
-	// The prompt removed auth/token logic.
-	// Standard SSE: browser handles Last-Event-ID header for native retries.
-	// If we manually retry, we might lose it unless we pass it.
-	// But wait, the prompt says "tinysse handles connection, reconnection".
-	// And "No Authentication". So we don't need to refresh tokens.
-	// So maybe we can rely on browser's native reconnection for network issues?
-	// However, `ClientConfig` has `RetryInterval` and `MaxRetryDelay`.
-	// Browsers have their own retry mechanism.
-	// The existing code had manual reconnection logic.
-	// I will keep manual reconnection logic just in case, or to respect config.
-	//
-	// Note on Last-Event-ID: Browser sends it automatically in HTTP header `Last-Event-ID`.
-	// We don't need to append it to URL usually.
-
-	url := c.config.Endpoint
-	c.es = js.Global().Get("EventSource").New(url)
-
-	c.es.Set("onmessage", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
-		c.reconnectAttempts = 0 // Reset on successful message
-
-		event := args[0]
-
-		// Parse SSE fields
-		// "data" is a string property of the event
-		// "lastEventId" is a string property
-		// "type" is the event type (e.g. "message", "update")
-
-		dataStr := event.Get("data").String()
-		eventID := event.Get("lastEventId").String()
-		eventType := event.Get("type").String()
-
-		// Update internal lastEventID
-		if eventID != "" {
-			c.lastEventID = eventID
-		}
+	// The browser sends the Last-Event-ID header on its native retries only.
+	// A new EventSource (our manual reconnect) can't set headers, so the last
+	// received ID is passed as the "lastEventId" query param instead.
+	c.closed = false
+	if c.state == StateClosed {
+		c.setState(StateConnecting, 0)
+	}
 
-		if c.handler != nil {
-			msg := &SSEMessage{
-				ID:    eventID,
-				Event: eventType,
-				Data:  []byte(dataStr), // Raw bytes from string
+	// Resume after a page reload
+	if c.config.PersistLastEventID && c.lastEventID == "" {
+		if storage := localStorage(); !storage.IsUndefined() {
+			if id := storage.Call("getItem", c.storageKey()); id.Type() == js.TypeString {
+				c.lastEventID = id.String()
 			}
+		}
+	}
+
+	token := ""
+	if c.config.TokenProvider != nil {
+		token = c.config.TokenProvider()
+	}
+	headers := c.config.Headers
+	if len(headers) > 0 && token != "" {
+		headers = make(map[string]string, len(c.config.Headers)+1)
+		for k, v := range c.config.Headers {
+			headers[k] = v
+		}
+		headers["Authorization"] = "Bearer " + token
+	}
+	switch {
+	case c.polling:
+		if len(headers) > 0 {
+			token = "" // Sent as a header
+		}
+		c.es = newPollEventSource(c.buildURL(c.config.LongPollEndpoint, token, ""), headers, c.lastEventID, c.config.WithCredentials)
+	case len(headers) > 0:
+		c.es = newFetchEventSource(c.url(""), headers, c.lastEventID, c.config.WithCredentials)
+	case c.config.WithCredentials:
+		options := js.Global().Get("Object").New()
+		options.Set("withCredentials", true)
+		c.es = js.Global().Get("EventSource").New(c.url(token), options)
+	default:
+		c.es = js.Global().Get("EventSource").New(c.url(token))
+	}
+	c.scheduleTokenRefresh()
+
+	if c.onMessage.IsUndefined() {
+		c.initCallbacks()
+	}
+	c.es.Set("onmessage", c.onMessage)
+
+	// Named events are not delivered to onmessage
+	for event := range c.eventHandlers {
+		c.addEventListener(event)
+	}
+	if c.config.HeartbeatTimeout > 0 {
+		if c.heartbeat.IsUndefined() {
+			c.heartbeat = js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+				c.lastActivity = time.Now()
+				return nil
+			})
+		}
+		c.es.Call("addEventListener", HeartbeatEvent, c.heartbeat)
+	}
+
+	c.es.Set("onerror", c.onError)
+
+	// Fired when readyState becomes OPEN, including after every reconnect
+	// since Connect re-attaches all handlers to the new EventSource.
+	c.es.Set("onopen", c.onOpen)
+}
+
+// initCallbacks creates the EventSource callbacks once: Connect attaches
+// them to every new source, so reconnects don't allocate js.Funcs that
+// are never released.
+func (c *SSEClient) initCallbacks() {
+	c.onMessage = js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		msg := c.parseEvent(args[0])
+		if handler := c.routeByData(msg); handler != nil {
+			handler(msg)
+		} else if c.handler != nil {
 			c.handler(msg)
+		} else {
+			c.holdEarly(msg)
+			return nil // Acked once delivered
 		}
+		c.ack(msg)
 		return nil
-	}))
+	})
 
-	c.es.Set("onerror", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+	c.onError = js.FuncOf(func(this js.Value, args []js.Value) interface{} {
 		// Event parsing
 		// args[0] is the event.
 		// readyState: 0=CONNECTING, 1=OPEN, 2=CLOSED
 		readyState := c.es.Get("readyState").Int()
 
-		if c.errorHandler != nil {
-			// Construct a meaningful error
-			// We can't get much detail from EventSource error event in browser for security reasons often.
-			// But we can report state.
-			c.errorHandler(fmt.Err("SSE connection error", "readyState", readyState))
+		// A stream that never opened is likely blocked: poll instead
+		if c.config.LongPollEndpoint != "" && !c.polling && !c.opened {
+			c.tinySSE.warn("SSE stream unavailable, falling back to long-polling")
+			c.polling = true
+			c.closeSource()
+			c.Connect()
+			return nil
+		}
+
+		// EventSource error events carry no detail for security reasons,
+		// so the code comes from readyState (and the HTTP status that
+		// only the Fetch transport exposes).
+		if readyState == ReadyStateClosed {
+			code := CodeServerClosed
+			if status := c.es.Get("status"); status.Type() == js.TypeNumber && (status.Int() == 401 || status.Int() == 403) {
+				code = CodeAuthFailed
+			}
+			c.reportError(code, fmt.Err("SSE connection error", "readyState", readyState, "CLOSED"))
+		} else {
+			c.reportError(CodeConnectionLost, fmt.Err("SSE connection error", "readyState", readyState, "CONNECTING"))
 		}
 
-		// If CLOSED (2), browser gave up (e.g. fatal error). We can try manual reconnect.
-		if readyState == 2 {
+		// If CLOSED, browser gave up (e.g. fatal error). We can try manual reconnect.
+		if readyState == ReadyStateClosed {
 			c.reconnect()
+		} else {
+			c.setState(StateReconnecting, 0) // Browser retries on its own
 		}
 		return nil
-	}))
+	})
 
-	// Open handler to reset attempts?
-	c.es.Set("onopen", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+	c.onOpen = js.FuncOf(func(this js.Value, args []js.Value) interface{} {
 		c.reconnectAttempts = 0
+		c.opened = true
+		c.setState(StateOpen, 0)
+		c.startWatchdog()
+		c.flushOffline()
+		if c.openHandler != nil {
+			c.openHandler()
+		}
 		return nil
-	}))
+	})
+}
+
+// url returns the stream endpoint with the requested channels, the token
+// and the last received event ID, if any, as query params.
+func (c *SSEClient) url(token string) string {
+	return c.buildURL(c.config.Endpoint, token, c.lastEventID)
+}
+
+// buildURL returns endpoint with the connection's query params; empty
+// token and lastEventID are left out.
+func (c *SSEClient) buildURL(endpoint, token, lastEventID string) string {
+	url := endpoint
+	add := func(key, value string) {
+		sep := "&"
+		if !fmt.Contains(url, "?") {
+			sep = "?"
+		}
+		url += sep + key + "=" + js.Global().Call("encodeURIComponent", value).String()
+	}
+
+	for _, ch := range c.config.Channels {
+		add("channel", ch)
+	}
+	if c.config.ClientID != "" {
+		add("clientId", c.config.ClientID)
+	}
+	if token != "" {
+		add("token", token)
+	}
+	if lastEventID != "" {
+		add("lastEventId", lastEventID)
+	}
+	return url
 }
 
 // Close closes the SSE connection.
+// Handlers are cleared and any pending reconnect is cancelled.
+// Safe to call more than once or before Connect.
 func (c *SSEClient) Close() {
+	c.closed = true
+	c.setState(StateClosed, 0)
+	c.stateHandler = nil
+	c.handler = nil
+	c.errorHandler = nil
+	c.openHandler = nil
+	c.eventHandlers = nil
+	c.early = nil
+	c.opened = false
+	c.polling = false
+
+	if !c.es.IsUndefined() && !c.es.IsNull() {
+		c.es.Set("onmessage", js.Null())
+		c.es.Set("onerror", js.Null())
+		c.es.Set("onopen", js.Null())
+	}
+	c.closeSource()
+	c.stopTokenRefresh()
+
+	// An explicit Close ends the session: don't resume on the next page load
+	if c.config.PersistLastEventID {
+		if storage := localStorage(); !storage.IsUndefined() {
+			storage.Call("removeItem", c.storageKey())
+		}
+	}
+}
+
+// scheduleTokenRefresh reconnects after ClientConfig.TokenRefreshInterval,
+// so the server sees a fresh token from TokenProvider before the current
+// one expires. The stream resumes from the last event ID.
+func (c *SSEClient) scheduleTokenRefresh() {
+	c.stopTokenRefresh()
+	if c.config.TokenProvider == nil || c.config.TokenRefreshInterval <= 0 {
+		return
+	}
+	if c.refresh.IsUndefined() {
+		c.refresh = js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+			c.refreshTimer = js.Undefined()
+			if !c.closed {
+				c.tinySSE.debug("SSE refreshing token")
+				c.closeSource()
+				c.Connect()
+			}
+			return nil
+		})
+	}
+	c.refreshTimer = js.Global().Call("setTimeout", c.refresh, c.config.TokenRefreshInterval)
+}
+
+// stopTokenRefresh cancels a pending token refresh.
+func (c *SSEClient) stopTokenRefresh() {
+	if !c.refreshTimer.IsUndefined() {
+		js.Global().Call("clearTimeout", c.refreshTimer)
+		c.refreshTimer = js.Undefined()
+	}
+}
+
+// startWatchdog begins checking for ClientConfig.HeartbeatTimeout on an
+// open stream.
+func (c *SSEClient) startWatchdog() {
+	if c.config.HeartbeatTimeout <= 0 {
+		return
+	}
+	c.lastActivity = time.Now()
+	c.armWatchdog(c.config.HeartbeatTimeout)
+}
+
+// armWatchdog checks for activity after ms milliseconds. A silent stream
+// is closed and reconnected, reported as StateReconnecting.
+func (c *SSEClient) armWatchdog(ms int) {
+	if c.watchdog.IsUndefined() {
+		c.watchdog = js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+			c.watchdogTimer = js.Undefined()
+			if c.closed {
+				return nil
+			}
+			timeout := time.Duration(c.config.HeartbeatTimeout) * time.Millisecond
+			if idle := time.Since(c.lastActivity); idle < timeout {
+				c.armWatchdog(int((timeout - idle).Milliseconds()) + 1)
+				return nil
+			}
+			c.tinySSE.warn("SSE heartbeat timeout, reconnecting")
+			c.reconnect()
+			return nil
+		})
+	}
+	c.watchdogTimer = js.Global().Call("setTimeout", c.watchdog, ms)
+}
+
+// stopWatchdog cancels a pending heartbeat check.
+func (c *SSEClient) stopWatchdog() {
+	if !c.watchdogTimer.IsUndefined() {
+		js.Global().Call("clearTimeout", c.watchdogTimer)
+		c.watchdogTimer = js.Undefined()
+	}
+}
+
+// storageKey is the localStorage key for the last event ID of this endpoint.
+func (c *SSEClient) storageKey() string {
+	return "tinysse:lastEventId:" + c.config.Endpoint
+}
+
+// localStorage returns window.localStorage, or undefined if unavailable.
+func localStorage() js.Value {
+	storage := js.Global().Get("localStorage")
+	if storage.IsNull() {
+		return js.Undefined()
+	}
+	return storage
+}
+
+// closeSource closes the underlying EventSource, keeping handlers.
+func (c *SSEClient) closeSource() {
+	c.stopWatchdog()
 	if !c.es.IsUndefined() && !c.es.IsNull() {
 		c.es.Call("close")
 	}
 }
 
-// OnMessage sets the handler for incoming messages.
+// ReadyState returns the EventSource readyState
+// (ReadyStateConnecting, ReadyStateOpen or ReadyStateClosed).
+// Returns ReadyStateClosed if Connect has not been called.
+func (c *SSEClient) ReadyState() int {
+	if c.es.IsUndefined() || c.es.IsNull() {
+		return ReadyStateClosed
+	}
+	return c.es.Get("readyState").Int()
+}
+
+// ConnectionID returns the ID the server assigned to the current
+// connection, e.g. to reference it in REST calls (SSEServer.SendToClient).
+// The server announces it in a comment that only the Fetch transport
+// (ClientConfig.Headers) can read; with the native EventSource, or before
+// the stream opens, it is "". Set ClientConfig.ClientID with the server's
+// AcceptClientID to choose the ID instead.
+func (c *SSEClient) ConnectionID() string {
+	if c.es.IsUndefined() || c.es.IsNull() {
+		return ""
+	}
+	if id := c.es.Get("connectionId"); id.Type() == js.TypeString {
+		return id.String()
+	}
+	return ""
+}
+
+// OnMessage sets the handler for incoming messages. Messages received
+// before it is set (Connect called first) are delivered to it right away,
+// up to the last 32.
 func (c *SSEClient) OnMessage(handler func(msg *SSEMessage)) {
 	c.handler = handler
+	if handler == nil {
+		return
+	}
+	early := c.early
+	c.early = nil
+	for _, msg := range early {
+		handler(msg)
+		c.ack(msg)
+	}
 }
 
-// OnError sets the handler for errors.
+// holdEarly keeps a message that arrived before OnMessage.
+func (c *SSEClient) holdEarly(msg *SSEMessage) {
+	if len(c.early) == maxEarlyMessages {
+		c.early = c.early[1:]
+	}
+	c.early = append(c.early, msg)
+}
+
+// On sets the handler for a named event (the SSE "event:" field).
+// Browsers deliver named events only to their listeners, not to OnMessage.
+func (c *SSEClient) On(event string, handler func(msg *SSEMessage)) {
+	if c.eventHandlers == nil {
+		c.eventHandlers = make(map[string]func(msg *SSEMessage))
+	}
+	_, exists := c.eventHandlers[event]
+	c.eventHandlers[event] = handler
+
+	// Already connected: attach to the current EventSource
+	if !exists && !c.es.IsUndefined() && !c.es.IsNull() {
+		c.addEventListener(event)
+	}
+}
+
+// routeByData returns the On handler for the type ClientConfig.EventType
+// reads from an unnamed message's data, setting msg.Event to it, or nil.
+func (c *SSEClient) routeByData(msg *SSEMessage) func(msg *SSEMessage) {
+	if c.config.EventType == nil {
+		return nil
+	}
+	event := c.config.EventType(msg.Data)
+	handler := c.eventHandlers[event]
+	if event == "" || handler == nil {
+		return nil
+	}
+	msg.Event = event
+	return handler
+}
+
+// addEventListener dispatches a named event to its registered handler.
+func (c *SSEClient) addEventListener(event string) {
+	listener, ok := c.listeners[event]
+	if !ok {
+		// Created once per event and reused by every connection
+		listener = js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+			msg := c.parseEvent(args[0])
+			if handler := c.eventHandlers[event]; handler != nil {
+				handler(msg)
+			}
+			c.ack(msg)
+			return nil
+		})
+		if c.listeners == nil {
+			c.listeners = make(map[string]js.Func)
+		}
+		c.listeners[event] = listener
+	}
+	c.es.Call("addEventListener", event, listener)
+}
+
+// ack POSTs the message ID to ClientConfig.AckEndpoint, if set.
+// Acks are cumulative on the server, so a lost one is covered by the next.
+func (c *SSEClient) ack(msg *SSEMessage) {
+	if c.config.AckEndpoint == "" || msg.ID == "" {
+		return
+	}
+	encode := js.Global().Get("encodeURIComponent")
+	sep := "?"
+	if fmt.Contains(c.config.AckEndpoint, "?") {
+		sep = "&"
+	}
+	url := c.config.AckEndpoint + sep + "client=" + encode.Invoke(c.config.ClientID).String() +
+		"&id=" + encode.Invoke(msg.ID).String()
+
+	options := js.Global().Get("Object").New()
+	options.Set("method", "POST")
+	if c.config.WithCredentials {
+		options.Set("credentials", "include") // Cookie auth, as for the stream
+	}
+	if c.ackFailed.IsUndefined() {
+		c.ackFailed = js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+			c.tinySSE.warn("SSE ack failed:", args[0].String())
+			return nil
+		})
+	}
+	js.Global().Call("fetch", url, options).Call("catch", c.ackFailed)
+}
+
+// parseEvent builds an SSEMessage from a JS MessageEvent and records its ID.
+func (c *SSEClient) parseEvent(event js.Value) *SSEMessage {
+	c.reconnectAttempts = 0 // Reset on successful message
+	c.lastActivity = time.Now()
+
+	// Parse SSE fields
+	// "data" is a string property of the event
+	// "lastEventId" is a string property
+	// "type" is the event type (e.g. "message", "update")
+	dataStr := event.Get("data").String()
+	eventID := event.Get("lastEventId").String()
+	eventType := event.Get("type").String()
+
+	// Update internal lastEventID
+	if eventID != "" {
+		c.lastEventID = eventID
+		if c.config.PersistLastEventID {
+			if storage := localStorage(); !storage.IsUndefined() {
+				storage.Call("setItem", c.storageKey(), eventID)
+			}
+		}
+	}
+
+	data := []byte(dataStr) // Raw bytes from string
+	if c.tinySSE.config.BinaryEncoding {
+		decoded, err := base64.StdEncoding.DecodeString(dataStr)
+		if err != nil {
+			c.tinySSE.error("SSE invalid base64 data:", err)
+			c.reportError(CodeDecodeError, err)
+		} else {
+			data = decoded
+		}
+	}
+
+	msg := &SSEMessage{
+		ID:    eventID,
+		Event: eventType,
+		Data:  data,
+	}
+	// Set by the Fetch transport from the "time:" field
+	if ts := event.Get("timestamp"); ts.Type() == js.TypeNumber {
+		msg.Timestamp = time.UnixMilli(int64(ts.Float()))
+	}
+	return msg
+}
+
+// SendWhenOnline runs send (e.g., a fetch POSTing a user action) now if the
+// stream is open, otherwise queues it until the connection is back, so
+// intents survive flaky networks. Queued intents run in order before the
+// OnOpen handler. At most ClientConfig.OfflineQueueSize are kept; the
+// oldest is dropped when full.
+func (c *SSEClient) SendWhenOnline(send func()) {
+	if c.ReadyState() == ReadyStateOpen {
+		send()
+		return
+	}
+	if len(c.offline) >= c.config.OfflineQueueSize {
+		c.tinySSE.warn("SSE offline queue full, dropping oldest intent")
+		c.offline = c.offline[1:]
+	}
+	c.offline = append(c.offline, send)
+}
+
+// flushOffline runs the intents queued while disconnected.
+func (c *SSEClient) flushOffline() {
+	queued := c.offline
+	c.offline = nil
+	for _, send := range queued {
+		send()
+	}
+}
+
+// OnOpen sets the handler called when the connection is established.
+func (c *SSEClient) OnOpen(handler func()) {
+	c.openHandler = handler
+}
+
+// OnStateChange sets a single handler for connection-status UI, called on
+// every transition. attempt is the manual reconnect attempt (1, 2, ...)
+// for StateReconnecting, 0 while the browser retries on its own and for
+// the other states.
+func (c *SSEClient) OnStateChange(handler func(state ConnectionState, attempt int)) {
+	c.stateHandler = handler
+}
+
+// setState records the state and notifies OnStateChange when it (or the
+// reconnect attempt) changes.
+func (c *SSEClient) setState(state ConnectionState, attempt int) {
+	if state == c.state && attempt == c.stateAttempt {
+		return
+	}
+	c.state, c.stateAttempt = state, attempt
+	if c.stateHandler != nil {
+		c.stateHandler(state, attempt)
+	}
+}
+
+// OnError sets the handler for errors. They are always *SSEError.
 func (c *SSEClient) OnError(handler func(err error)) {
 	c.errorHandler = handler
 }
 
+// reportError passes err to the OnError handler as an SSEError.
+func (c *SSEClient) reportError(code ErrorCode, err error) {
+	if c.errorHandler != nil {
+		c.errorHandler(&SSEError{Code: code, Err: err})
+	}
+}
+
+// reconnect is the manual fallback once the browser gives up (readyState CLOSED).
+// It only uses ClientConfig delays: a server "retry:" hint is applied by the
+// browser's native reconnection and is never exposed to us, so it is not
+// handled twice.
 func (c *SSEClient) reconnect() {
-	c.Close()
+	c.closeSource()
 
 	if c.config.MaxReconnectAttempts > 0 && c.reconnectAttempts >= c.config.MaxReconnectAttempts {
-		if c.errorHandler != nil {
-			c.errorHandler(fmt.Err("max reconnect attempts reached"))
-		}
+		c.setState(StateClosed, 0)
+		c.reportError(CodeConnectionLost, fmt.Err("max reconnect attempts reached"))
 		return
 	}
 
-	delay := c.config.RetryInterval * (1 << c.reconnectAttempts)
+	if c.retry.IsUndefined() {
+		c.retry = js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+			if !c.closed {
+				c.Connect()
+			}
+			return nil
+		})
+	}
+	js.Global().Call("setTimeout", c.retry, c.backoff())
+
+	c.reconnectAttempts++
+	c.setState(StateReconnecting, c.reconnectAttempts)
+}
+
+// backoff returns the next reconnect delay in ms: exponential from
+// RetryInterval up to MaxRetryDelay, randomized within its upper half so
+// clients dropped together (e.g., a server restart) don't reconnect at once.
+func (c *SSEClient) backoff() int {
+	// Stop doubling at the cap: shifting further would overflow
+	delay := c.config.RetryInterval
+	for i := 0; i < c.reconnectAttempts && delay < c.config.MaxRetryDelay; i++ {
+		delay *= 2
+	}
 	if delay > c.config.MaxRetryDelay {
 		delay = c.config.MaxRetryDelay
 	}
 	if delay <= 0 {
 		delay = 1000 // Default 1s if misconfigured
 	}
-
-	js.Global().Call("setTimeout", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
-		c.Connect()
-		return nil
-	}), delay)
-
-	c.reconnectAttempts++
+	random := js.Global().Get("Math").Call("random").Float()
+	return delay/2 + int(random*float64(delay/2))
 }
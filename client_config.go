@@ -2,17 +2,134 @@
 
 package sse
 
+import "github.com/tinywasm/fmt"
+
+// Reconnection defaults used when the ClientConfig values are 0.
+const (
+	DefaultRetryInterval = 3000  // ms
+	DefaultMaxRetryDelay = 30000 // ms
+
+	DefaultOfflineQueueSize = 50
+)
+
 // ClientConfig holds configuration strictly for the Browser/WASM Client.
 type ClientConfig struct {
 	// Endpoint is the SSE server URL.
 	Endpoint string
 
+	// Channels are requested as repeated "channel" query params
+	// (URL-encoded, so names like "room:1/a b" are safe). The server's
+	// ChannelProvider decides which ones are granted (see RequestedChannels).
+	Channels []string
+
+	// Headers are sent with the SSE request (e.g., "Authorization").
+	// EventSource can't send headers, so when set the client reads the
+	// stream with the Fetch API instead. Empty = native EventSource.
+	Headers map[string]string
+
+	// TokenProvider, if set, returns the auth token sent on every
+	// (re)connect: as "Authorization: Bearer" with Headers, otherwise as
+	// the "token" query param (see BearerToken on the server). It runs in
+	// a JS callback, so it must not block: return a token the app keeps
+	// fresh (e.g., renewed from a goroutine).
+	TokenProvider func() string
+
+	// TokenRefreshInterval, in milliseconds, reconnects with a fresh
+	// TokenProvider token before the current one expires; the stream
+	// resumes from the last event ID. 0 = only on reconnects.
+	TokenRefreshInterval int
+
+	// WithCredentials sends cookies on cross-origin connections (e.g.,
+	// cookie auth across subdomains), passing {withCredentials: true} to
+	// EventSource. The server must list the exact origin in AllowedOrigins
+	// ("*" does not allow credentials).
+	WithCredentials bool
+
+	// LongPollEndpoint, if set, is polled (see SSEServer.LongPollHandler)
+	// when the stream fails before ever opening, e.g. in networks whose
+	// proxies block streaming. The client keeps polling until Close;
+	// handlers, reconnection and Last-Event-ID work the same.
+	LongPollEndpoint string
+
+	// PersistLastEventID stores the last received event ID in localStorage
+	// (keyed by Endpoint) so the stream resumes after a page reload.
+	// The stored ID is cleared by Close.
+	PersistLastEventID bool
+
+	// AckEndpoint, if set, is POSTed "?client=<ClientID>&id=<message ID>"
+	// after each message's handler returns, acknowledging messages sent
+	// with the server's PublishWithAck (see SSEServer.AckHandler).
+	AckEndpoint string
+
+	// ClientID identifies this client in acknowledgements. It is sent as
+	// the "clientId" query param, which the server adopts as the connection
+	// ID with ServerConfig.AcceptClientID; otherwise it must match the ID
+	// the server assigns (ServerConfig.GenerateClientID).
+	ClientID string
+
+	// EventType, if set, routes unnamed messages by their data: when it
+	// returns a type with an On handler (e.g., the "type" field of a JSON
+	// body), that handler gets the message instead of OnMessage. Decode with
+	// any JSON library; the client itself stays free of encoding/json.
+	EventType func(data []byte) string
+
 	// RetryInterval in milliseconds for reconnection.
+	// Default: DefaultRetryInterval (3000).
 	RetryInterval int
 
-	// MaxRetryDelay caps the exponential backoff.
+	// MaxRetryDelay caps the exponential backoff, in milliseconds.
+	// Default: DefaultMaxRetryDelay (30000).
 	MaxRetryDelay int
 
+	// HeartbeatTimeout, in milliseconds, closes and reconnects a stream
+	// that received nothing (messages or HeartbeatEvent) for this long,
+	// catching connections dropped silently. Set it above the server's
+	// HeartbeatInterval, with ServerConfig.HeartbeatAsEvent enabled.
+	// 0 = rely on the browser to detect drops.
+	HeartbeatTimeout int
+
 	// MaxReconnectAttempts limits retry attempts. 0 = unlimited.
 	MaxReconnectAttempts int
+
+	// OfflineQueueSize caps the intents held by SendWhenOnline while
+	// disconnected; when full, the oldest is dropped.
+	// Default: DefaultOfflineQueueSize (50).
+	OfflineQueueSize int
+}
+
+// Validate rejects negative values and fills defaults for zero values.
+// Client calls it, logging any error; call it directly to surface errors.
+// Defaults are applied even when an error is returned.
+func (c *ClientConfig) Validate() error {
+	var err error
+	switch {
+	case c.Endpoint == "":
+		err = fmt.Err("Endpoint", "is required")
+	case c.RetryInterval < 0:
+		err = fmt.Err("RetryInterval", "must not be negative")
+	case c.MaxRetryDelay < 0:
+		err = fmt.Err("MaxRetryDelay", "must not be negative")
+	case c.MaxReconnectAttempts < 0:
+		err = fmt.Err("MaxReconnectAttempts", "must not be negative")
+	case c.HeartbeatTimeout < 0:
+		err = fmt.Err("HeartbeatTimeout", "must not be negative")
+	case c.TokenRefreshInterval < 0:
+		err = fmt.Err("TokenRefreshInterval", "must not be negative")
+	case c.OfflineQueueSize < 0:
+		err = fmt.Err("OfflineQueueSize", "must not be negative")
+	}
+
+	if c.RetryInterval <= 0 {
+		c.RetryInterval = DefaultRetryInterval
+	}
+	if c.MaxRetryDelay <= 0 {
+		c.MaxRetryDelay = DefaultMaxRetryDelay
+	}
+	if c.OfflineQueueSize <= 0 {
+		c.OfflineQueueSize = DefaultOfflineQueueSize
+	}
+	if c.MaxReconnectAttempts < 0 {
+		c.MaxReconnectAttempts = 0
+	}
+	return err
 }
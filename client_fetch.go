@@ -0,0 +1,275 @@
+//go:build wasm
+
+package sse
+
+import (
+	"bytes"
+	"syscall/js"
+
+	"github.com/tinywasm/fmt"
+)
+
+// newFetchEventSource returns a JS object that behaves like an EventSource
+// (readyState, close, onopen/onmessage/onerror, addEventListener) but reads
+// the stream with the Fetch API, so custom headers can be sent.
+// SSEClient uses it transparently when ClientConfig.Headers is set.
+// withCredentials sends cookies cross-origin, like EventSource's option.
+func newFetchEventSource(url string, headers map[string]string, lastEventID string, withCredentials bool) js.Value {
+	s := newShim(lastEventID)
+	options := fetchOptions(headers, s.controller, withCredentials)
+	if lastEventID != "" {
+		options.Get("headers").Set("Last-Event-ID", lastEventID)
+	}
+
+	var read js.Func
+	var reader js.Value
+	onChunk := js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		result := args[0]
+		if result.Get("done").Bool() {
+			s.fail()
+			s.release()
+			return nil
+		}
+		value := result.Get("value")
+		chunk := make([]byte, value.Get("length").Int())
+		js.CopyBytesToGo(chunk, value)
+		s.feed(chunk)
+		read.Invoke()
+		return nil
+	})
+	onFailure := js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		s.fail() // Also reached once close aborts the pending request
+		s.release()
+		return nil
+	})
+	read = js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		reader.Call("read").Call("then", onChunk).Call("catch", onFailure)
+		return nil
+	})
+
+	onResponse := js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		resp := args[0]
+		if !resp.Get("ok").Bool() || resp.Get("body").IsNull() {
+			s.es.Set("status", resp.Get("status")) // Read by SSEClient to detect auth failures
+			s.fail()
+			s.release()
+			return nil
+		}
+		s.open()
+		reader = resp.Get("body").Call("getReader")
+		read.Invoke()
+		return nil
+	})
+	s.funcs = []js.Func{onChunk, onFailure, read, onResponse}
+
+	js.Global().Call("fetch", url, options).Call("then", onResponse).Call("catch", onFailure)
+	return s.es
+}
+
+// shim is a JS object with the EventSource API (readyState, close,
+// addEventListener; the app sets onopen/onmessage/onerror) for the
+// transports that read the stream themselves.
+type shim struct {
+	es         js.Value
+	controller js.Value // Aborts the transport's requests on close
+	listeners  map[string][]js.Value
+	parser     *sseParser
+	funcs      []js.Func // The transport's callbacks, see release
+}
+
+// shims holds the live shims by their es.shimId, for the methods shared by
+// every shim: a connection allocates no js.Func that outlives it.
+var (
+	shims                = make(map[int]*shim)
+	lastShimID           int
+	shimAddEventListener js.Func
+	shimClose            js.Func
+)
+
+func newShim(lastEventID string) *shim {
+	if shimClose.IsUndefined() {
+		shimAddEventListener = js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+			if s := shims[this.Get("shimId").Int()]; s != nil {
+				event := args[0].String()
+				s.listeners[event] = append(s.listeners[event], args[1])
+			}
+			return nil
+		})
+		shimClose = js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+			this.Set("readyState", ReadyStateClosed)
+			if s := shims[this.Get("shimId").Int()]; s != nil {
+				s.controller.Call("abort")
+			}
+			return nil
+		})
+	}
+	lastShimID++
+	s := &shim{
+		es:         js.Global().Get("Object").New(),
+		controller: js.Global().Get("AbortController").New(),
+		listeners:  make(map[string][]js.Value),
+		parser:     &sseParser{lastEventID: lastEventID},
+	}
+	shims[lastShimID] = s
+	s.es.Set("shimId", lastShimID)
+	s.es.Set("readyState", ReadyStateConnecting)
+	s.es.Set("addEventListener", shimAddEventListener)
+	s.es.Set("close", shimClose)
+	return s
+}
+
+// release frees the transport's callbacks once no request is pending
+// anymore, and forgets the shim.
+func (s *shim) release() {
+	for _, fn := range s.funcs {
+		fn.Release()
+	}
+	s.funcs = nil
+	delete(shims, s.es.Get("shimId").Int())
+}
+
+// fail marks the shim closed and reports it like EventSource does.
+func (s *shim) fail() {
+	if s.es.Get("readyState").Int() == ReadyStateClosed {
+		return // Closed by us
+	}
+	s.es.Set("readyState", ReadyStateClosed)
+	if onerror := s.es.Get("onerror"); onerror.Type() == js.TypeFunction {
+		onerror.Invoke(js.Global().Get("Object").New())
+	}
+}
+
+// open marks the shim open and fires onopen.
+func (s *shim) open() {
+	s.es.Set("readyState", ReadyStateOpen)
+	if onopen := s.es.Get("onopen"); onopen.Type() == js.TypeFunction {
+		onopen.Invoke(js.Global().Get("Object").New())
+	}
+}
+
+// feed parses a chunk of the stream, dispatching its events.
+func (s *shim) feed(chunk []byte) {
+	s.parser.feed(chunk, s.emit)
+	setConnectionID(s.es, s.parser)
+}
+
+// emit dispatches an event to onmessage or its named listeners, as
+// EventSource does.
+func (s *shim) emit(id, event string, data []byte) {
+	setConnectionID(s.es, s.parser)
+	msg := js.Global().Get("Object").New()
+	msg.Set("data", string(data))
+	msg.Set("lastEventId", id)
+	msg.Set("type", event)
+	if s.parser.time > 0 {
+		msg.Set("timestamp", s.parser.time)
+	}
+	if event == "message" {
+		if onmessage := s.es.Get("onmessage"); onmessage.Type() == js.TypeFunction {
+			onmessage.Invoke(msg)
+		}
+		return
+	}
+	for _, listener := range s.listeners[event] {
+		listener.Invoke(msg)
+	}
+}
+
+// fetchOptions returns the fetch() options for a stream or poll request.
+func fetchOptions(headers map[string]string, controller js.Value, withCredentials bool) js.Value {
+	jsHeaders := js.Global().Get("Object").New()
+	for k, v := range headers {
+		jsHeaders.Set(k, v)
+	}
+	jsHeaders.Set("Accept", "text/event-stream")
+
+	options := js.Global().Get("Object").New()
+	options.Set("headers", jsHeaders)
+	options.Set("cache", "no-store")
+	options.Set("signal", controller.Get("signal"))
+	if withCredentials {
+		options.Set("credentials", "include")
+	}
+	return options
+}
+
+// setConnectionID exposes the parsed connection ID as es.connectionId,
+// read by SSEClient.ConnectionID.
+func setConnectionID(es js.Value, p *sseParser) {
+	if p.connectionID != "" {
+		es.Set("connectionId", p.connectionID)
+	}
+}
+
+// sseParser incrementally parses the SSE wire format (id/event/data/retry lines).
+type sseParser struct {
+	buf         []byte
+	data        []byte
+	hasData     bool
+	event       string
+	lastEventID string
+	time        int64 // "time:" field (unix ms) of the current event, 0 if absent
+
+	connectionID string // From the server's ": connected id=..." comment
+}
+
+// feed parses a chunk and calls emit for every complete event.
+func (p *sseParser) feed(chunk []byte, emit func(id, event string, data []byte)) {
+	p.buf = append(p.buf, chunk...)
+	for {
+		i := bytes.IndexByte(p.buf, '\n')
+		if i < 0 {
+			return
+		}
+		line := bytes.TrimSuffix(p.buf[:i], []byte("\r"))
+		p.buf = p.buf[i+1:]
+		p.parseLine(line, emit)
+	}
+}
+
+func (p *sseParser) parseLine(line []byte, emit func(id, event string, data []byte)) {
+	// Blank line dispatches the event
+	if len(line) == 0 {
+		if p.hasData {
+			event := p.event
+			if event == "" {
+				event = "message"
+			}
+			emit(p.lastEventID, event, p.data)
+		}
+		p.data, p.hasData, p.event, p.time = nil, false, "", 0
+		return
+	}
+
+	// Comment (e.g., ": ping" or ": connected id=<ID> time=<ms>")
+	if line[0] == ':' {
+		if rest, ok := bytes.CutPrefix(line, []byte(": connected id=")); ok {
+			id, _, _ := bytes.Cut(rest, []byte(" "))
+			p.connectionID = string(id)
+		}
+		return
+	}
+
+	field, value := line, []byte(nil)
+	if i := bytes.IndexByte(line, ':'); i >= 0 {
+		field, value = line[:i], bytes.TrimPrefix(line[i+1:], []byte(" "))
+	}
+
+	switch string(field) {
+	case "data":
+		if p.hasData {
+			p.data = append(p.data, '\n')
+		}
+		p.data = append(p.data, value...)
+		p.hasData = true
+	case "event":
+		p.event = string(value)
+	case "id":
+		p.lastEventID = string(value)
+	case "time":
+		if ms, err := fmt.Convert(string(value)).Int64(); err == nil {
+			p.time = ms
+		}
+	}
+	// "retry" is ignored: reconnection delays come from ClientConfig.
+}
@@ -0,0 +1,62 @@
+//go:build wasm
+
+package sse
+
+import (
+	"syscall/js"
+
+	"github.com/tinywasm/fmt"
+)
+
+// newPollEventSource returns an EventSource-like JS object (see shim) that
+// long-polls url with the Fetch API: each response holds the events after
+// the last received ID, and the next poll starts as soon as it is read.
+// SSEClient falls back to it with ClientConfig.LongPollEndpoint.
+func newPollEventSource(url string, headers map[string]string, lastEventID string, withCredentials bool) js.Value {
+	s := newShim(lastEventID)
+	options := fetchOptions(headers, s.controller, withCredentials)
+
+	var poll func()
+	onText := js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		s.feed([]byte(args[0].String()))
+		poll()
+		return nil
+	})
+	onResponse := js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		resp := args[0]
+		if !resp.Get("ok").Bool() {
+			s.es.Set("status", resp.Get("status")) // Read by SSEClient to detect auth failures
+			s.fail()
+			s.release()
+			return nil
+		}
+		if s.es.Get("readyState").Int() == ReadyStateConnecting {
+			s.open()
+		}
+		return resp.Call("text").Call("then", onText)
+	})
+	onFailure := js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		s.fail() // Also reached once close aborts the pending request
+		s.release()
+		return nil
+	})
+	s.funcs = []js.Func{onText, onResponse, onFailure}
+	poll = func() {
+		if s.es.Get("readyState").Int() == ReadyStateClosed {
+			s.release()
+			return
+		}
+		next := url
+		if id := s.parser.lastEventID; id != "" {
+			sep := "&"
+			if !fmt.Contains(next, "?") {
+				sep = "?"
+			}
+			next += sep + "lastEventId=" + js.Global().Call("encodeURIComponent", id).String()
+		}
+		js.Global().Call("fetch", next, options).Call("then", onResponse).Call("catch", onFailure)
+	}
+
+	poll()
+	return s.es
+}
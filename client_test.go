@@ -5,6 +5,9 @@ package sse
 import (
 	"syscall/js"
 	"testing"
+	"time"
+
+	. "github.com/tinywasm/fmt"
 )
 
 // This test requires `wasmbrowsertest` or a similar environment.
@@ -98,3 +101,932 @@ func TestClientOnMessage(t *testing.T) {
 		t.Errorf("expected ID '123', got %s", received.ID)
 	}
 }
+
+func TestClientEarlyMessages(t *testing.T) {
+	var esInstance js.Value
+	js.Global().Set("EventSource", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		obj := js.Global().Get("Object").New()
+		obj.Set("readyState", ReadyStateOpen)
+		obj.Set("close", js.FuncOf(func(this js.Value, args []js.Value) interface{} { return nil }))
+		esInstance = obj
+		return obj
+	}))
+
+	client := New(&Config{}).Client(&ClientConfig{Endpoint: "/test"})
+	client.Connect()
+	for i := 1; i <= maxEarlyMessages+2; i++ {
+		event := js.Global().Get("Object").New()
+		event.Set("data", Convert(i).String())
+		event.Set("type", "message")
+		esInstance.Get("onmessage").Invoke(event)
+	}
+
+	// Registered late: gets the newest held messages, the oldest dropped
+	var got []string
+	client.OnMessage(func(msg *SSEMessage) { got = append(got, string(msg.Data)) })
+	if len(got) != maxEarlyMessages || got[0] != "3" || got[len(got)-1] != Convert(maxEarlyMessages+2).String() {
+		t.Errorf("unexpected early messages: %v", got)
+	}
+
+	// Nothing is delivered twice
+	client.OnMessage(func(msg *SSEMessage) { t.Error("early message replayed again") })
+	client.Close()
+}
+
+func TestClientOnOpen(t *testing.T) {
+	var esInstance js.Value
+	js.Global().Set("EventSource", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		obj := js.Global().Get("Object").New()
+		obj.Set("readyState", 0)
+		obj.Set("close", js.FuncOf(func(this js.Value, args []js.Value) interface{} { return nil }))
+		esInstance = obj
+		return obj
+	}))
+
+	client := New(&Config{}).Client(&ClientConfig{Endpoint: "/test"})
+
+	opened := 0
+	client.OnOpen(func() {
+		opened++
+	})
+
+	client.Connect()
+	esInstance.Get("onopen").Invoke(js.Global().Get("Object").New())
+
+	// A new EventSource (e.g. after reconnect) must keep the handler
+	client.Connect()
+	esInstance.Get("onopen").Invoke(js.Global().Get("Object").New())
+
+	if opened != 2 {
+		t.Errorf("expected OnOpen to fire twice, got %d", opened)
+	}
+}
+
+func TestClientWithCredentials(t *testing.T) {
+	var options js.Value
+	js.Global().Set("EventSource", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		options = js.Undefined()
+		if len(args) > 1 {
+			options = args[1]
+		}
+		obj := js.Global().Get("Object").New()
+		obj.Set("readyState", 0)
+		obj.Set("close", js.FuncOf(func(this js.Value, args []js.Value) interface{} { return nil }))
+		return obj
+	}))
+
+	client := New(&Config{}).Client(&ClientConfig{Endpoint: "/test", WithCredentials: true})
+	client.Connect()
+	if options.IsUndefined() || !options.Get("withCredentials").Bool() {
+		t.Error("expected withCredentials to be passed to EventSource")
+	}
+	client.Close()
+
+	plain := New(&Config{}).Client(&ClientConfig{Endpoint: "/test"})
+	plain.Connect()
+	if !options.IsUndefined() {
+		t.Error("expected no options without WithCredentials")
+	}
+	plain.Close()
+}
+
+func TestClientReadyStateAndOnError(t *testing.T) {
+	var esInstance js.Value
+	js.Global().Set("EventSource", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		obj := js.Global().Get("Object").New()
+		obj.Set("readyState", ReadyStateConnecting)
+		obj.Set("close", js.FuncOf(func(this js.Value, args []js.Value) interface{} { return nil }))
+		esInstance = obj
+		return obj
+	}))
+
+	client := New(&Config{}).Client(&ClientConfig{Endpoint: "/test"})
+	if state := client.ReadyState(); state != ReadyStateClosed {
+		t.Errorf("expected CLOSED before Connect, got %d", state)
+	}
+
+	var received error
+	client.OnError(func(err error) {
+		received = err
+	})
+	client.Connect()
+
+	if state := client.ReadyState(); state != ReadyStateConnecting {
+		t.Errorf("expected CONNECTING, got %d", state)
+	}
+
+	esInstance.Get("onerror").Invoke(js.Global().Get("Object").New())
+	if received == nil || !Contains(received.Error(), "CONNECTING") {
+		t.Errorf("expected error describing CONNECTING state, got %v", received)
+	}
+}
+
+func TestClientClose(t *testing.T) {
+	closeCalls := 0
+	var esInstance js.Value
+	js.Global().Set("EventSource", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		obj := js.Global().Get("Object").New()
+		obj.Set("readyState", ReadyStateOpen)
+		obj.Set("close", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+			closeCalls++
+			return nil
+		}))
+		esInstance = obj
+		return obj
+	}))
+
+	client := New(&Config{}).Client(&ClientConfig{Endpoint: "/test"})
+
+	// Before Connect: no-op
+	client.Close()
+
+	client.OnMessage(func(msg *SSEMessage) {
+		t.Error("handler called after Close")
+	})
+	client.Connect()
+	client.Close()
+	client.Close()
+
+	if closeCalls != 2 {
+		t.Errorf("expected EventSource.close to be called twice, got %d", closeCalls)
+	}
+	if !esInstance.Get("onmessage").IsNull() {
+		t.Error("onmessage should be cleared")
+	}
+	if !client.closed {
+		t.Error("closed flag not set")
+	}
+}
+
+func TestClientNamedEvents(t *testing.T) {
+	listeners := map[string]js.Value{}
+	js.Global().Set("EventSource", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		obj := js.Global().Get("Object").New()
+		obj.Set("readyState", ReadyStateOpen)
+		obj.Set("close", js.FuncOf(func(this js.Value, args []js.Value) interface{} { return nil }))
+		obj.Set("addEventListener", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+			listeners[args[0].String()] = args[1]
+			return nil
+		}))
+		return obj
+	}))
+
+	client := New(&Config{}).Client(&ClientConfig{Endpoint: "/test"})
+
+	var chat, typing *SSEMessage
+	client.On("chat", func(msg *SSEMessage) { chat = msg })
+	client.Connect()
+	client.On("typing", func(msg *SSEMessage) { typing = msg })
+
+	event := js.Global().Get("Object").New()
+	event.Set("data", "hi")
+	event.Set("lastEventId", "5")
+	event.Set("type", "chat")
+	listeners["chat"].Invoke(event)
+
+	if chat == nil {
+		t.Fatal("chat handler not called")
+	}
+	verifyMessage(t, chat, "chat", []byte("hi"))
+	if typing != nil {
+		t.Error("typing handler should not be called")
+	}
+	if _, ok := listeners["typing"]; !ok {
+		t.Error("handler registered after Connect was not attached")
+	}
+}
+
+func TestClientReconnectSendsLastEventID(t *testing.T) {
+	var urls []string
+	var esInstance js.Value
+	js.Global().Set("EventSource", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		urls = append(urls, args[0].String())
+		obj := js.Global().Get("Object").New()
+		obj.Set("readyState", ReadyStateOpen)
+		obj.Set("close", js.FuncOf(func(this js.Value, args []js.Value) interface{} { return nil }))
+		esInstance = obj
+		return obj
+	}))
+
+	client := New(&Config{}).Client(&ClientConfig{
+		Endpoint:      "/events?room=1",
+		RetryInterval: 1,
+		MaxRetryDelay: 10,
+	})
+	client.Connect()
+
+	event := js.Global().Get("Object").New()
+	event.Set("data", "x")
+	event.Set("lastEventId", "7")
+	event.Set("type", "message")
+	esInstance.Get("onmessage").Invoke(event)
+
+	// Browser gave up: manual reconnect after RetryInterval
+	esInstance.Set("readyState", ReadyStateClosed)
+	esInstance.Get("onerror").Invoke(js.Global().Get("Object").New())
+	if client.reconnectAttempts != 1 {
+		t.Errorf("expected 1 reconnect attempt, got %d", client.reconnectAttempts)
+	}
+	// Wait for the reconnect timer to create and wire the new EventSource
+	for i := 0; i < 50 && (len(urls) < 2 || esInstance.Get("onopen").IsUndefined()); i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	if len(urls) != 2 {
+		t.Fatalf("expected a second EventSource, got %d", len(urls))
+	}
+	if urls[1] != "/events?room=1&lastEventId=7" {
+		t.Errorf("unexpected reconnect URL: %s", urls[1])
+	}
+
+	// A successful open resets the backoff
+	esInstance.Get("onopen").Invoke(js.Global().Get("Object").New())
+	if client.reconnectAttempts != 0 {
+		t.Errorf("expected backoff reset after open, got %d", client.reconnectAttempts)
+	}
+}
+
+func TestSSEParser(t *testing.T) {
+	type event struct{ id, name, data string }
+	var got []event
+	emit := func(id, name string, data []byte) {
+		got = append(got, event{id, name, string(data)})
+	}
+
+	p := &sseParser{}
+	// Chunks split mid-line must be reassembled
+	p.feed([]byte(": ping\n\nid: 1\nevent: chat\ndata: line1\nda"), emit)
+	p.feed([]byte("ta: line2\r\n\ndata: plain\n\n"), emit)
+
+	if len(got) != 2 {
+		t.Fatalf("expected 2 events, got %d", len(got))
+	}
+	if got[0] != (event{"1", "chat", "line1\nline2"}) {
+		t.Errorf("unexpected first event: %+v", got[0])
+	}
+	// The last event ID persists and the default event type is "message"
+	if got[1] != (event{"1", "message", "plain"}) {
+		t.Errorf("unexpected second event: %+v", got[1])
+	}
+}
+
+func TestSSEParserMultiline(t *testing.T) {
+	var data string
+	p := &sseParser{}
+	// Wire output of the server for "{\n  \"a\": 1,\r\n\n  \"b\": 2\n}"
+	p.feed([]byte("id: 3\ndata: {\ndata:   \"a\": 1,\ndata: \ndata:   \"b\": 2\ndata: }\n\n"), func(id, name string, d []byte) {
+		data = string(d)
+	})
+
+	if want := "{\n  \"a\": 1,\n\n  \"b\": 2\n}"; data != want {
+		t.Errorf("expected %q, got %q", want, data)
+	}
+}
+
+func TestClientLongPollFallback(t *testing.T) {
+	// The stream is blocked: it fails before ever opening
+	var esInstance js.Value
+	js.Global().Set("EventSource", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		obj := js.Global().Get("Object").New()
+		obj.Set("readyState", ReadyStateClosed)
+		obj.Set("close", js.FuncOf(func(this js.Value, args []js.Value) interface{} { return nil }))
+		esInstance = obj
+		return obj
+	}))
+
+	var urls []string
+	js.Global().Set("fetch", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		urls = append(urls, args[0].String())
+		if len(urls) > 1 {
+			// Holds the next poll open
+			return js.Global().Get("Promise").New(js.FuncOf(func(this js.Value, args []js.Value) interface{} { return nil }))
+		}
+		resp := js.Global().Get("Object").New()
+		resp.Set("ok", true)
+		resp.Set("text", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+			return js.Global().Get("Promise").Call("resolve", "id: 5\ndata: polled\n\n")
+		}))
+		return js.Global().Get("Promise").Call("resolve", resp)
+	}))
+
+	client := New(&Config{}).Client(&ClientConfig{
+		Endpoint:         "/events",
+		LongPollEndpoint: "/poll",
+		Channels:         []string{"news"},
+	})
+	received := make(chan *SSEMessage, 1)
+	client.OnMessage(func(msg *SSEMessage) { received <- msg })
+	client.Connect()
+	esInstance.Get("onerror").Invoke(js.Global().Get("Object").New())
+
+	select {
+	case msg := <-received:
+		verifyMessage(t, msg, "message", []byte("polled"))
+	case <-time.After(time.Second):
+		t.Fatal("message not received by polling")
+	}
+	for len(urls) < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	if urls[0] != "/poll?channel=news" || urls[1] != "/poll?channel=news&lastEventId=5" {
+		t.Errorf("unexpected poll URLs: %v", urls)
+	}
+	if client.ReadyState() != ReadyStateOpen {
+		t.Errorf("expected polling to report open, got %d", client.ReadyState())
+	}
+	client.Close()
+}
+
+func TestClientFetchTransport(t *testing.T) {
+	var requestHeaders js.Value
+	chunks := []string{": connected id=c7 time=1700000000000\n\nid: 3\ndata: hello\n\n"}
+
+	js.Global().Set("fetch", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		requestHeaders = args[1].Get("headers")
+
+		reader := js.Global().Get("Object").New()
+		reader.Set("read", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+			result := js.Global().Get("Object").New()
+			if len(chunks) == 0 {
+				result.Set("done", true)
+			} else {
+				result.Set("done", false)
+				value := js.Global().Get("Uint8Array").New(len(chunks[0]))
+				js.CopyBytesToJS(value, []byte(chunks[0]))
+				result.Set("value", value)
+				chunks = chunks[1:]
+			}
+			return js.Global().Get("Promise").Call("resolve", result)
+		}))
+		body := js.Global().Get("Object").New()
+		body.Set("getReader", js.FuncOf(func(this js.Value, args []js.Value) interface{} { return reader }))
+		resp := js.Global().Get("Object").New()
+		resp.Set("ok", true)
+		resp.Set("body", body)
+		return js.Global().Get("Promise").Call("resolve", resp)
+	}))
+
+	client := New(&Config{}).Client(&ClientConfig{
+		Endpoint:             "/events",
+		Headers:              map[string]string{"Authorization": "Bearer abc"},
+		MaxReconnectAttempts: 1,
+	})
+
+	received := make(chan *SSEMessage, 1)
+	var connectionID string
+	client.OnMessage(func(msg *SSEMessage) {
+		connectionID = client.ConnectionID()
+		received <- msg
+	})
+	live := len(shims) // Other tests may hold a request open
+	client.Connect()
+
+	select {
+	case msg := <-received:
+		verifyMessage(t, msg, "message", []byte("hello"))
+		if msg.ID != "3" {
+			t.Errorf("expected ID 3, got %s", msg.ID)
+		}
+		if connectionID != "c7" {
+			t.Errorf("expected connection ID c7 from the comment, got %q", connectionID)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("message not received over fetch transport")
+	}
+	if requestHeaders.Get("Authorization").String() != "Bearer abc" {
+		t.Error("custom header not sent")
+	}
+
+	// The stream ended: its callbacks are released
+	for i := 0; i < 100 && len(shims) > live; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if len(shims) != live {
+		t.Errorf("expected the ended stream released, %d left", len(shims)-live)
+	}
+	client.Close()
+}
+
+func TestClientReusesCallbacks(t *testing.T) {
+	var sources []js.Value
+	js.Global().Set("EventSource", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		obj := js.Global().Get("Object").New()
+		obj.Set("readyState", ReadyStateConnecting)
+		obj.Set("close", js.FuncOf(func(this js.Value, args []js.Value) interface{} { return nil }))
+		obj.Set("addEventListener", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+			this.Set("on"+args[0].String(), args[1])
+			return nil
+		}))
+		sources = append(sources, obj)
+		return obj
+	}))
+
+	client := New(&Config{}).Client(&ClientConfig{Endpoint: "/events"})
+	client.On("chat", func(msg *SSEMessage) {})
+	client.Connect()
+	client.closeSource()
+	client.Connect() // e.g. a token refresh
+
+	for _, prop := range []string{"onmessage", "onerror", "onopen", "onchat"} {
+		if !sources[0].Get(prop).Equal(sources[1].Get(prop)) {
+			t.Errorf("expected %s to be reused across connections", prop)
+		}
+	}
+	client.Close()
+}
+
+func TestClientPersistLastEventID(t *testing.T) {
+	store := js.Global().Get("Object").New()
+	storage := js.Global().Get("Object").New()
+	storage.Set("getItem", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		v := store.Get(args[0].String())
+		if v.IsUndefined() {
+			return nil
+		}
+		return v
+	}))
+	storage.Set("setItem", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		store.Set(args[0].String(), args[1])
+		return nil
+	}))
+	storage.Set("removeItem", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		store.Delete(args[0].String())
+		return nil
+	}))
+	js.Global().Set("localStorage", storage)
+	defer js.Global().Delete("localStorage")
+
+	var url string
+	var esInstance js.Value
+	js.Global().Set("EventSource", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		url = args[0].String()
+		obj := js.Global().Get("Object").New()
+		obj.Set("readyState", ReadyStateOpen)
+		obj.Set("close", js.FuncOf(func(this js.Value, args []js.Value) interface{} { return nil }))
+		esInstance = obj
+		return obj
+	}))
+
+	cfg := &ClientConfig{Endpoint: "/events", PersistLastEventID: true}
+	first := New(&Config{}).Client(cfg)
+	first.Connect()
+	event := js.Global().Get("Object").New()
+	event.Set("data", "x")
+	event.Set("lastEventId", "42")
+	event.Set("type", "message")
+	esInstance.Get("onmessage").Invoke(event)
+
+	// Simulates a page reload: a brand new client
+	New(&Config{}).Client(cfg).Connect()
+	if url != "/events?lastEventId=42" {
+		t.Errorf("expected stored ID in URL, got %s", url)
+	}
+
+	// ClientID is suggested to the server as the connection ID
+	New(&Config{}).Client(&ClientConfig{Endpoint: "/events", ClientID: "tab 1"}).Connect()
+	if url != "/events?clientId=tab%201" {
+		t.Errorf("expected clientId in URL, got %s", url)
+	}
+
+	first.Close()
+	if !store.Get("tinysse:lastEventId:/events").IsUndefined() {
+		t.Error("stored ID not cleared by Close")
+	}
+}
+
+func TestClientChannelsQuery(t *testing.T) {
+	var url string
+	js.Global().Set("EventSource", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		url = args[0].String()
+		obj := js.Global().Get("Object").New()
+		obj.Set("readyState", ReadyStateConnecting)
+		obj.Set("close", js.FuncOf(func(this js.Value, args []js.Value) interface{} { return nil }))
+		return obj
+	}))
+
+	client := New(&Config{}).Client(&ClientConfig{
+		Endpoint: "/events",
+		Channels: []string{"chat", "room:a b"},
+	})
+	client.Connect()
+
+	if url != "/events?channel=chat&channel=room%3Aa%20b" {
+		t.Errorf("unexpected URL: %s", url)
+	}
+}
+
+func TestClientConfigValidate(t *testing.T) {
+	cfg := &ClientConfig{Endpoint: "/events"}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.RetryInterval != DefaultRetryInterval || cfg.MaxRetryDelay != DefaultMaxRetryDelay {
+		t.Errorf("defaults not applied: %+v", cfg)
+	}
+
+	if err := (&ClientConfig{Endpoint: "/events", RetryInterval: -1}).Validate(); err == nil {
+		t.Error("expected error for negative RetryInterval")
+	}
+	if err := (&ClientConfig{}).Validate(); err == nil {
+		t.Error("expected error for missing Endpoint")
+	}
+}
+
+func TestClientBinaryEncoding(t *testing.T) {
+	client := New(&Config{BinaryEncoding: true}).Client(&ClientConfig{Endpoint: "/events"})
+
+	event := js.Global().Get("Object").New()
+	event.Set("data", "AAEKAv8=") // 0x00 0x01 '\n' 0x02 0xff
+	event.Set("lastEventId", "1")
+	event.Set("type", "message")
+
+	msg := client.parseEvent(event)
+	want := []byte{0x00, 0x01, '\n', 0x02, 0xff}
+	if string(msg.Data) != string(want) {
+		t.Errorf("expected %v, got %v", want, msg.Data)
+	}
+}
+
+func TestClientAck(t *testing.T) {
+	var onmessage js.Value
+	js.Global().Set("EventSource", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		obj := js.Global().Get("Object").New()
+		obj.Set("readyState", ReadyStateOpen)
+		obj.Set("close", js.FuncOf(func(this js.Value, args []js.Value) interface{} { return nil }))
+		return obj
+	}))
+	var acks []string
+	var credentials string
+	js.Global().Set("fetch", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		acks = append(acks, args[1].Get("method").String()+" "+args[0].String())
+		credentials = args[1].Get("credentials").String()
+		return js.Global().Get("Promise").Call("resolve")
+	}))
+
+	client := New(&Config{}).Client(&ClientConfig{
+		Endpoint:        "/events",
+		AckEndpoint:     "/ack",
+		ClientID:        "tab 1",
+		WithCredentials: true,
+	})
+	var handled bool
+	client.OnMessage(func(msg *SSEMessage) { handled = true })
+	client.Connect()
+	onmessage = client.es.Get("onmessage")
+
+	event := js.Global().Get("Object").New()
+	event.Set("data", "order")
+	event.Set("lastEventId", "7")
+	event.Set("type", "message")
+	onmessage.Invoke(event)
+
+	if !handled || len(acks) != 1 || acks[0] != "POST /ack?client=tab%201&id=7" {
+		t.Errorf("unexpected acks: %v", acks)
+	}
+	if credentials != "include" {
+		t.Errorf("expected the ack to send cookies, got %q", credentials)
+	}
+}
+
+func TestSSEParserTimestamp(t *testing.T) {
+	var times []int64
+	p := &sseParser{}
+	p.feed([]byte("id: 1\ntime: 1700000000123\ndata: a\n\nid: 2\ndata: b\n\n"), func(id, name string, data []byte) {
+		times = append(times, p.time)
+	})
+
+	if len(times) != 2 || times[0] != 1700000000123 || times[1] != 0 {
+		t.Errorf("unexpected timestamps: %v", times)
+	}
+}
+
+func TestClientBackoffJitter(t *testing.T) {
+	client := New(&Config{}).Client(&ClientConfig{
+		Endpoint:      "/events",
+		RetryInterval: 1000,
+		MaxRetryDelay: 30000,
+	})
+
+	seen := map[int]bool{}
+	for i := 0; i < 10; i++ {
+		delay := client.backoff()
+		if delay < 500 || delay > 1000 {
+			t.Fatalf("delay %d outside [500, 1000]", delay)
+		}
+		seen[delay] = true
+	}
+	if len(seen) < 2 {
+		t.Error("expected consecutive reconnect delays to differ")
+	}
+
+	// Capped by MaxRetryDelay, even after enough attempts to overflow
+	for _, attempts := range []int{10, 52, 64, 1000} {
+		client.reconnectAttempts = attempts
+		if delay := client.backoff(); delay < 15000 || delay > 30000 {
+			t.Errorf("attempt %d: capped delay %d outside [15000, 30000]", attempts, delay)
+		}
+	}
+}
+
+func TestClientSendWhenOnline(t *testing.T) {
+	var esInstance js.Value
+	js.Global().Set("EventSource", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		obj := js.Global().Get("Object").New()
+		obj.Set("readyState", 0)
+		obj.Set("close", js.FuncOf(func(this js.Value, args []js.Value) interface{} { return nil }))
+		esInstance = obj
+		return obj
+	}))
+
+	client := New(&Config{}).Client(&ClientConfig{Endpoint: "/test", OfflineQueueSize: 2})
+
+	var sent []string
+	opened := false
+	client.OnOpen(func() {
+		if len(sent) != 2 {
+			t.Errorf("queued intents must run before OnOpen, got %v", sent)
+		}
+		opened = true
+	})
+	for _, intent := range []string{"a", "b", "c"} {
+		client.SendWhenOnline(func() { sent = append(sent, intent) })
+	}
+	if len(sent) != 0 {
+		t.Fatal("intents must wait while disconnected")
+	}
+
+	client.Connect()
+	esInstance.Set("readyState", ReadyStateOpen)
+	esInstance.Get("onopen").Invoke(js.Global().Get("Object").New())
+	if !opened || len(sent) != 2 || sent[0] != "b" || sent[1] != "c" {
+		t.Errorf("expected oldest dropped and [b c] flushed, got %v", sent)
+	}
+
+	client.SendWhenOnline(func() { sent = append(sent, "d") })
+	if len(sent) != 3 {
+		t.Error("expected intent to run immediately while open")
+	}
+}
+
+func TestClientOnStateChange(t *testing.T) {
+	var esInstance js.Value
+	js.Global().Set("EventSource", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		obj := js.Global().Get("Object").New()
+		obj.Set("readyState", ReadyStateConnecting)
+		obj.Set("close", js.FuncOf(func(this js.Value, args []js.Value) interface{} { return nil }))
+		esInstance = obj
+		return obj
+	}))
+
+	client := New(&Config{}).Client(&ClientConfig{
+		Endpoint:             "/test",
+		RetryInterval:        1000,
+		MaxReconnectAttempts: 1,
+	})
+	var got []string
+	client.OnStateChange(func(state ConnectionState, attempt int) {
+		got = append(got, state.String()+":"+Convert(attempt).String())
+	})
+
+	client.Connect()
+	esInstance.Get("onopen").Invoke(js.Global().Get("Object").New())
+	esInstance.Get("onerror").Invoke(js.Global().Get("Object").New()) // Browser retrying
+	esInstance.Set("readyState", ReadyStateClosed)
+	esInstance.Get("onerror").Invoke(js.Global().Get("Object").New()) // Manual attempt 1
+	esInstance.Get("onerror").Invoke(js.Global().Get("Object").New()) // Max attempts reached
+	client.Close()
+
+	want := "connecting:0 open:0 reconnecting:0 reconnecting:1 closed:0"
+	if s := Convert(got).Join(" ").String(); s != want {
+		t.Errorf("expected %q, got %q", want, s)
+	}
+}
+
+func TestClientReconnectRestoresChannels(t *testing.T) {
+	var urls []string
+	var listeners []string
+	var esInstance js.Value
+	js.Global().Set("EventSource", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		urls = append(urls, args[0].String())
+		obj := js.Global().Get("Object").New()
+		obj.Set("readyState", ReadyStateOpen)
+		obj.Set("close", js.FuncOf(func(this js.Value, args []js.Value) interface{} { return nil }))
+		obj.Set("addEventListener", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+			listeners = append(listeners, args[0].String())
+			return nil
+		}))
+		esInstance = obj
+		return obj
+	}))
+
+	client := New(&Config{}).Client(&ClientConfig{
+		Endpoint:      "/events",
+		Channels:      []string{"chat", "alerts"},
+		RetryInterval: 1,
+		MaxRetryDelay: 10,
+	})
+	client.On("typing", func(msg *SSEMessage) {})
+	client.Connect()
+
+	// Connection dropped and the browser gave up
+	esInstance.Set("readyState", ReadyStateClosed)
+	esInstance.Get("onerror").Invoke(js.Global().Get("Object").New())
+	for i := 0; i < 50 && len(listeners) < 2; i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	if len(urls) != 2 {
+		t.Fatalf("expected a new EventSource, got %d", len(urls))
+	}
+	if urls[1] != urls[0] || !Contains(urls[1], "channel=chat&channel=alerts") {
+		t.Errorf("channels not restored on reconnect: %q", urls)
+	}
+	if len(listeners) != 2 || listeners[1] != "typing" {
+		t.Errorf("named event listeners not restored: %q", listeners)
+	}
+}
+
+func TestClientTokenRefresh(t *testing.T) {
+	var urls []string
+	var esInstance js.Value
+	js.Global().Set("EventSource", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		urls = append(urls, args[0].String())
+		obj := js.Global().Get("Object").New()
+		obj.Set("readyState", ReadyStateOpen)
+		obj.Set("close", js.FuncOf(func(this js.Value, args []js.Value) interface{} { return nil }))
+		esInstance = obj
+		return obj
+	}))
+
+	tokens := 0
+	client := New(&Config{}).Client(&ClientConfig{
+		Endpoint: "/events",
+		TokenProvider: func() string {
+			tokens++
+			return "t" + Convert(tokens).String()
+		},
+		TokenRefreshInterval: 5,
+	})
+	client.Connect()
+
+	event := js.Global().Get("Object").New()
+	event.Set("data", "x")
+	event.Set("lastEventId", "9")
+	event.Set("type", "message")
+	esInstance.Get("onmessage").Invoke(event)
+
+	for i := 0; i < 50 && len(urls) < 2; i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+	client.Close()
+	n := len(urls)
+	time.Sleep(20 * time.Millisecond)
+
+	if n < 2 || urls[0] != "/events?token=t1" || urls[1] != "/events?token=t2&lastEventId=9" {
+		t.Fatalf("expected reconnect with a fresh token, got %q", urls)
+	}
+	if len(urls) != n {
+		t.Error("token refresh must stop after Close")
+	}
+}
+
+func TestClientEventTypeRouting(t *testing.T) {
+	var esInstance js.Value
+	js.Global().Set("EventSource", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		obj := js.Global().Get("Object").New()
+		obj.Set("readyState", ReadyStateOpen)
+		obj.Set("close", js.FuncOf(func(this js.Value, args []js.Value) interface{} { return nil }))
+		obj.Set("addEventListener", js.FuncOf(func(this js.Value, args []js.Value) interface{} { return nil }))
+		esInstance = obj
+		return obj
+	}))
+
+	client := New(&Config{}).Client(&ClientConfig{
+		Endpoint: "/events",
+		EventType: func(data []byte) string {
+			// Stand-in for a JSON decoder reading the "type" field
+			if s := string(data); HasPrefix(s, `{"type":"`) {
+				return Convert(s[len(`{"type":"`):]).Split(`"`)[0]
+			}
+			return ""
+		},
+	})
+	var order, generic *SSEMessage
+	client.On("order", func(msg *SSEMessage) { order = msg })
+	client.OnMessage(func(msg *SSEMessage) { generic = msg })
+	client.Connect()
+
+	for _, data := range []string{`{"type":"order","id":1}`, `not json`} {
+		event := js.Global().Get("Object").New()
+		event.Set("data", data)
+		event.Set("lastEventId", "")
+		event.Set("type", "message")
+		esInstance.Get("onmessage").Invoke(event)
+	}
+
+	if order == nil || order.Event != "order" {
+		t.Errorf("expected typed message routed to On(order), got %+v", order)
+	}
+	if generic == nil || string(generic.Data) != "not json" {
+		t.Errorf("expected fallback to OnMessage, got %+v", generic)
+	}
+}
+
+func TestClientHeartbeatTimeout(t *testing.T) {
+	created := 0
+	var esInstance js.Value
+	var heartbeat js.Value
+	js.Global().Set("EventSource", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		created++
+		obj := js.Global().Get("Object").New()
+		obj.Set("readyState", ReadyStateOpen)
+		obj.Set("close", js.FuncOf(func(this js.Value, args []js.Value) interface{} { return nil }))
+		obj.Set("addEventListener", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+			if args[0].String() == HeartbeatEvent {
+				heartbeat = args[1]
+			}
+			return nil
+		}))
+		esInstance = obj
+		return obj
+	}))
+
+	client := New(&Config{}).Client(&ClientConfig{
+		Endpoint:         "/events",
+		HeartbeatTimeout: 30,
+		RetryInterval:    1,
+		MaxRetryDelay:    2,
+	})
+	var states []string
+	client.OnStateChange(func(state ConnectionState, attempt int) {
+		states = append(states, state.String())
+	})
+	client.Connect()
+	esInstance.Get("onopen").Invoke(js.Global().Get("Object").New())
+
+	// Heartbeats keep the stream alive
+	for i := 0; i < 4; i++ {
+		time.Sleep(15 * time.Millisecond)
+		heartbeat.Invoke(js.Global().Get("Object").New())
+	}
+	if created != 1 {
+		t.Fatalf("stream with heartbeats must not reconnect, got %d EventSources", created)
+	}
+
+	// Silence: reconnect
+	for i := 0; i < 40 && created < 2; i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+	client.Close()
+	if created < 2 {
+		t.Fatal("silent stream was not reconnected")
+	}
+	if Convert(states).Join(" ").String() != "connecting open reconnecting closed" {
+		t.Errorf("unexpected states %v", states)
+	}
+}
+
+func TestClientSSEErrorCodes(t *testing.T) {
+	var esInstance js.Value
+	js.Global().Set("EventSource", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		obj := js.Global().Get("Object").New()
+		obj.Set("readyState", ReadyStateConnecting)
+		obj.Set("close", js.FuncOf(func(this js.Value, args []js.Value) interface{} { return nil }))
+		esInstance = obj
+		return obj
+	}))
+
+	client := New(&Config{BinaryEncoding: true}).Client(&ClientConfig{Endpoint: "/events", RetryInterval: 60000})
+	var codes []ErrorCode
+	client.OnError(func(err error) {
+		sseErr, ok := err.(*SSEError)
+		if !ok {
+			t.Fatalf("expected *SSEError, got %T", err)
+		}
+		codes = append(codes, sseErr.Code)
+	})
+	client.Connect()
+
+	esInstance.Get("onerror").Invoke(js.Global().Get("Object").New())
+	esInstance.Set("readyState", ReadyStateClosed)
+	esInstance.Get("onerror").Invoke(js.Global().Get("Object").New())
+	esInstance.Set("status", 401)
+	esInstance.Get("onerror").Invoke(js.Global().Get("Object").New())
+
+	event := js.Global().Get("Object").New()
+	event.Set("data", "not base64!")
+	event.Set("lastEventId", "")
+	event.Set("type", "message")
+	esInstance.Get("onmessage").Invoke(event)
+	client.Close()
+
+	want := []ErrorCode{CodeConnectionLost, CodeServerClosed, CodeAuthFailed, CodeDecodeError}
+	if len(codes) != len(want) {
+		t.Fatalf("expected %v, got %v", want, codes)
+	}
+	for i := range want {
+		if codes[i] != want[i] {
+			t.Errorf("error %d: expected code %d, got %d", i, want[i], codes[i])
+		}
+	}
+}
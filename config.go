@@ -2,7 +2,29 @@ package sse
 
 // Config holds the shared configuration for both Server and Client.
 type Config struct {
-	// Log is the centralized logger function.
-	// If nil, logging is disabled.
+	// Log is the centralized logger function. It receives every message,
+	// whatever its level. If nil (and Logger is nil), logging is disabled.
 	Log func(args ...any)
+
+	// Logger receives messages by level, e.g. to route them into slog or
+	// zap. Takes precedence over Log when set.
+	Logger Logger
+
+	// BinaryEncoding sends every message's Data base64-encoded on the wire
+	// and decodes it on the client, so arbitrary bytes (protobuf, images)
+	// survive SSE's text format. Must be set on both server and client.
+	BinaryEncoding bool
+}
+
+// Logger is a leveled logger. The first argument is always the message.
+//
+//   - Debug: per-message details (drops, rejected channels)
+//   - Info: connection lifecycle (connect, disconnect)
+//   - Warn: rejected requests and misbehaving clients
+//   - Error: invalid configuration or data
+type Logger interface {
+	Debug(args ...any)
+	Info(args ...any)
+	Warn(args ...any)
+	Error(args ...any)
 }
@@ -0,0 +1,58 @@
+//go:build !wasm
+
+package sse
+
+import "net/http"
+
+// handleCORS applies ServerConfig.AllowedOrigins to the request; a
+// preflight is answered with the endpoint's method ("GET" or "POST").
+// It returns false when the response has already been written: a
+// rejected origin (403) or an answered preflight request.
+func (s *SSEServer) handleCORS(w http.ResponseWriter, r *http.Request, method string) bool {
+	origin := r.Header.Get("Origin")
+	if len(s.config.AllowedOrigins) == 0 || origin == "" {
+		return true // Same-origin or CORS not configured
+	}
+
+	allowed, exact := s.matchOrigin(origin)
+	if !allowed {
+		s.tinySSE.warn("SSE origin rejected:", origin)
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return false
+	}
+
+	// Listed origins are echoed so credentialed requests (cookies) work.
+	// "*" never allows credentials: any site could read the user's stream.
+	h := w.Header()
+	if exact {
+		h.Set("Access-Control-Allow-Origin", origin)
+		h.Set("Access-Control-Allow-Credentials", "true")
+		h.Add("Vary", "Origin")
+	} else {
+		h.Set("Access-Control-Allow-Origin", "*")
+	}
+
+	if r.Method == http.MethodOptions {
+		h.Set("Access-Control-Allow-Methods", method+", OPTIONS")
+		if reqHeaders := r.Header.Get("Access-Control-Request-Headers"); reqHeaders != "" {
+			h.Set("Access-Control-Allow-Headers", reqHeaders)
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return false
+	}
+	return true
+}
+
+// matchOrigin reports whether origin is allowed, and whether it is listed
+// exactly rather than only matched by "*".
+func (s *SSEServer) matchOrigin(origin string) (allowed, exact bool) {
+	for _, candidate := range s.config.AllowedOrigins {
+		if candidate == origin {
+			return true, true
+		}
+		if candidate == "*" {
+			allowed = true
+		}
+	}
+	return allowed, false
+}
@@ -0,0 +1,43 @@
+//go:build !wasm
+
+package sse
+
+// HubSnapshot is a copy of the hub state for debugging, safe to serialize
+// (e.g., as JSON from an internal /debug/sse endpoint).
+type HubSnapshot struct {
+	Clients    int            // Connected clients
+	Paused     int            // Connected clients currently paused
+	Channels   map[string]int // Subscribers per channel
+	HistoryLen int            // Entries in the HistoryStore
+	Unacked    int            // PublishWithAck messages awaiting an ack
+	LastID     string         // ID of the last published message
+	Closed     bool           // Shutdown was called
+}
+
+// DebugSnapshot returns the current hub state. It is built on the hub
+// goroutine, so the values are consistent with each other.
+func (s *SSEServer) DebugSnapshot() HubSnapshot {
+	var snap HubSnapshot
+	s.hub.do(func() {
+		h := s.hub
+		snap = HubSnapshot{
+			Clients:    len(h.clients),
+			Channels:   make(map[string]int),
+			HistoryLen: len(h.history.Since("")),
+			LastID:     h.lastMsgID,
+			Closed:     h.closed,
+		}
+		for _, c := range h.clients {
+			if c.paused {
+				snap.Paused++
+			}
+			for _, ch := range c.channels {
+				snap.Channels[ch]++
+			}
+		}
+		for _, pending := range h.unacked {
+			snap.Unacked += len(pending)
+		}
+	})
+	return snap
+}
@@ -0,0 +1,143 @@
+//go:build !wasm
+
+package sse
+
+import (
+	"bytes"
+	"sync"
+	"time"
+)
+
+// HistoryEntry is a published message as kept by a HistoryStore.
+type HistoryEntry struct {
+	Message SSEMessage
+	Target  Target
+	Key     string // PublishLatest key; only the newest per key is replayed
+	Created time.Time
+}
+
+// memoryHistory is the default in-memory HistoryStore.
+type memoryHistory struct {
+	mu      sync.RWMutex
+	entries []HistoryEntry
+}
+
+func newMemoryHistory(capacity int) *memoryHistory {
+	if capacity < 0 {
+		capacity = 0
+	}
+	return &memoryHistory{entries: make([]HistoryEntry, 0, capacity)}
+}
+
+func (m *memoryHistory) Append(entry HistoryEntry) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.entries = append(m.entries, entry)
+}
+
+func (m *memoryHistory) Since(lastEventID string) []HistoryEntry {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	start := 0
+	if lastEventID != "" {
+		start = -1
+		for i, entry := range m.entries {
+			if entry.Message.ID == lastEventID {
+				start = i + 1
+				break
+			}
+		}
+		if start == -1 {
+			return nil
+		}
+	}
+
+	out := make([]HistoryEntry, len(m.entries)-start)
+	copy(out, m.entries[start:])
+	return out
+}
+
+func (m *memoryHistory) Trim(max int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if max < 0 {
+		max = 0
+	}
+	if len(m.entries) > max {
+		m.entries = m.entries[len(m.entries)-max:] // Remove oldest
+	}
+}
+
+func (m *memoryHistory) Len() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return len(m.entries)
+}
+
+func (m *memoryHistory) Remove(ids ...string) {
+	drop := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		drop[id] = true
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	kept := m.entries[:0]
+	for _, entry := range m.entries {
+		if !drop[entry.Message.ID] {
+			kept = append(kept, entry)
+		}
+	}
+	clear(m.entries[len(kept):])
+	m.entries = kept
+}
+
+// HistorySnapshot returns up to limit of the most recent history messages
+// published to the given channels (or to all clients), oldest first,
+// regardless of any Last-Event-ID. Use it for a "catch up on load"
+// endpoint: a fresh page fetches it once, then opens the stream with the
+// last returned ID. Messages targeted at a user, role or client are left
+// out, as are expired ones. limit <= 0 returns all of them.
+func (s *SSEServer) HistorySnapshot(channels []string, limit int) []SSEMessage {
+	var msgs []SSEMessage
+	s.hub.do(func() {
+		h := s.hub
+		reader := &clientConnection{channels: s.config.expandGroups(channels)}
+		var entries []HistoryEntry
+		for _, entry := range h.history.Since("") {
+			if h.isTarget(reader, entry.Target) && !h.isExpired(entry) {
+				entries = append(entries, entry)
+			}
+		}
+		for _, entry := range latestOnly(h.sortEntries(entries)) {
+			msg := entry.Message
+			msg.Data = bytes.Clone(msg.Data) // Callers may modify it
+			msgs = append(msgs, msg)
+		}
+	})
+	if limit > 0 && len(msgs) > limit {
+		msgs = msgs[len(msgs)-limit:]
+	}
+	return msgs
+}
+
+// LastID returns the sequence of the last published message (0 if none).
+// Its message ID is that number, or ServerConfig.IDFormat of it.
+func (s *SSEServer) LastID() uint64 {
+	var seq uint64
+	s.hub.do(func() {
+		seq = s.hub.lastSeq
+	})
+	return seq
+}
+
+// ResetHistory discards every stored message, e.g. after a schema change
+// that invalidates old events. The ID sequence continues, so IDs are never
+// reused: clients reconnecting with an older Last-Event-ID get a GapEvent
+// and should reload their state.
+func (s *SSEServer) ResetHistory() {
+	s.hub.do(func() {
+		s.hub.trimHistory(0)
+	})
+}
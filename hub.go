@@ -4,7 +4,16 @@ package sse
 
 import (
 	"bytes"
+	"context"
+	crand "crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"math/rand/v2"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	. "github.com/tinywasm/fmt"
 )
@@ -14,8 +23,8 @@ type hub struct {
 	tinySSE *tinySSE
 	config  *ServerConfig
 
-	// Registered clients.
-	clients map[*clientConnection]bool
+	// Registered clients, keyed by client ID.
+	clients map[string]*clientConnection
 
 	// Inbound messages from the clients.
 	broadcast chan *broadcastMessage
@@ -26,31 +35,169 @@ type hub struct {
 	// Unregister requests from clients.
 	unregister chan *clientConnection
 
+	// Functions run on the hub goroutine with exclusive access to its state.
+	exec chan func()
+
+	// Shutdown requests. The hub replies with the clients it closed.
+	shutdown chan chan []*clientConnection
+	closed   bool
+
+	metrics Metrics
+
+	// bus forwards local messages to other nodes, tagged with nodeID.
+	bus    BusAdapter
+	nodeID string
+
 	// History buffer
-	history      []*historyItem
-	historyMutex sync.RWMutex
-	lastID       int
+	history   HistoryStore
+	lastSeq   uint64
+	lastMsgID string
+
+	// Highest sequence dropped from history, by retention bucket: "" for
+	// HistoryReplayBuffer, HistoryTTL and ResetHistory, else the
+	// ChannelRetention channel. Tells a replay gap from a Remove()d entry.
+	trimmed map[string]int
+
+	// Messages sent with PublishWithAck and not acknowledged yet, by client ID.
+	unacked map[string][]*SSEMessage
+
+	// Disconnected client IDs still tracked in unacked, oldest first,
+	// capped at MaxUnacked.
+	departed []string
+
+	// Open PublishBatched windows, keyed by their joined channels.
+	batches map[string]*pendingBatch
+
+	// LongPollHandler requests waiting for their next message.
+	pollers map[*clientConnection]struct{}
+
+	// Presence announcements made during a dispatch, sent once it is done.
+	dispatching   bool
+	announcements []*broadcastMessage
+
+	// Sequence for client IDs, used instead of random IDs when counterIDs
+	// is set (NewTestServer).
+	lastClientID atomic.Uint64
+	counterIDs   bool
 }
 
 type registerRequest struct {
 	client      *clientConnection
 	lastEventID string
+	suggestedID bool // client.id came from the clientId query param
+
+	// assigned, if set, receives the registration result. Must be
+	// buffered.
+	assigned chan registered
+}
+
+// registered is the reply to a registerRequest: the final client ID (""
+// if rejected) and the frames to replay, which the handler writes before
+// draining send. Replay never waits on the client from the hub, however
+// long it is.
+type registered struct {
+	id     string
+	replay [][]byte
+}
+
+// reply sends the result on req.assigned. Without one (in-memory clients)
+// the replay is queued on send as far as it fits.
+func (req registerRequest) reply(id string, replay [][]byte) {
+	if req.assigned != nil {
+		req.assigned <- registered{id: id, replay: replay}
+		return
+	}
+	for _, data := range replay {
+		select {
+		case req.client.send <- data:
+		default:
+		}
+	}
 }
 
 type broadcastMessage struct {
-	msg      *SSEMessage
-	channels []string
+	msg    *SSEMessage
+	target Target
+
+	// sender, if set, is the client that caused the message; it is
+	// checked against ServerConfig.PerClientRateLimit.
+	sender string
+
+	// key, if set, makes the message replace the one with the same key
+	// still queued for each client (PublishLatest).
+	key string
+
+	// remote marks messages received from another node's BusAdapter,
+	// which must not be published back to the bus.
+	remote bool
+
+	// ack tracks the message per client until acknowledged (PublishWithAck).
+	ack bool
+
+	// stats, if set, receives the delivery result once the message is sent.
+	stats chan DeliveryStats
+
+	// ctx, if set, aborts the per-client send loop when cancelled.
+	// err is set before stats is sent, so it is safe to read after receiving.
+	ctx context.Context
+	err error
 }
 
-type historyItem struct {
-	msg      *SSEMessage
-	channels []string
+// Target selects which clients receive a message.
+// All matches every client; otherwise the first non-empty field of
+// ClientID, UserID and Role wins, then Channels are used.
+// Clients listed in Exclude never match.
+// It is stored with each HistoryEntry so replay applies the same selection.
+type Target struct {
+	All      bool
+	Channels []string
+	UserID   string
+	Role     string
+	ClientID string
+	Exclude  []string
 }
 
 // clientConnection represents a connected SSE client on the server side.
 type clientConnection struct {
+	id       string
+	userID   string
+	role     string
 	channels []string
+	metadata map[string]string
 	send     chan []byte
+
+	// high is the PriorityHigh lane, drained before send. Nil falls back
+	// to send.
+	high chan []byte
+
+	// http1Host is the remote IP when served over HTTP/1.x, to warn about
+	// the browser per-domain connection limit. Empty over HTTP/2.
+	http1Host string
+
+	// limiter enforces PerClientRateLimit on messages this client causes.
+	limiter tokenBucket
+
+	// paused holds messages in pending instead of sending them (Pause).
+	paused  bool
+	pending [][]byte
+
+	// latest tracks PublishLatest frames, so a newer one replaces those
+	// still undelivered.
+	latest latestFrames
+
+	// farewell, if set, is written by the handler once send is closed,
+	// after the queued messages were discarded (see remove).
+	farewell []byte
+
+	// fullSince is when the buffer started dropping messages for this
+	// client; zero while it keeps up. Used by SlowClientTimeout.
+	fullSince time.Time
+
+	// done is closed (closeDone) when the HTTP handler serving this client
+	// returns or evicts it, so a blocking send never waits on a stream
+	// that is gone.
+	done     chan struct{}
+	doneOnce sync.Once
 }
 
 func newHub(t *tinySSE, c *ServerConfig) *hub {
@@ -60,9 +207,28 @@ func newHub(t *tinySSE, c *ServerConfig) *hub {
 		broadcast:  make(chan *broadcastMessage),
 		register:   make(chan registerRequest),
 		unregister: make(chan *clientConnection),
-		clients:    make(map[*clientConnection]bool),
-		history:    make([]*historyItem, 0, c.HistoryReplayBuffer),
+		exec:       make(chan func()),
+		shutdown:   make(chan chan []*clientConnection),
+		clients:    make(map[string]*clientConnection),
+		unacked:    make(map[string][]*SSEMessage),
+		batches:    make(map[string]*pendingBatch),
+		pollers:    make(map[*clientConnection]struct{}),
+		history:    c.HistoryStore,
+		trimmed:    make(map[string]int),
+	}
+	if h.history == nil {
+		h.history = newMemoryHistory(c.historyCapacity())
+	}
+	h.metrics = c.Metrics
+	if h.metrics == nil {
+		h.metrics = noopMetrics{}
+	}
+	h.bus = c.Bus
+	if h.bus == nil {
+		h.bus = noopBus{}
 	}
+	h.nodeID = Convert(int64(rand.Uint64() >> 1)).String() // fmt has no uint64 above MaxInt64
+	h.bus.Subscribe(h.receiveFromBus)
 	go h.run()
 	return h
 }
@@ -71,90 +237,702 @@ func (h *hub) run() {
 	for {
 		select {
 		case req := <-h.register:
-			h.clients[req.client] = true
-			h.replayHistory(req.client, req.lastEventID)
+			// Closing send makes the handler return; MaxClients is checked
+			// again here since concurrent connects may pass the early check.
+			if h.closed || h.isFull() {
+				req.reply("", nil)
+				close(req.client.send)
+				continue
+			}
+			// IDs are generated here, so GenerateClientID is never called
+			// concurrently. A client-suggested ID in use falls back to a
+			// generated one, and default IDs skip the ones clients suggested.
+			if req.client.id == "" {
+				req.client.id = h.nextClientID()
+			} else if req.suggestedID && h.taken(req.client) {
+				h.tinySSE.debug("SSE suggested client ID in use:", req.client.id)
+				req.client.id = h.nextClientID()
+			}
+			for h.config.GenerateClientID == nil && h.taken(req.client) {
+				req.client.id = h.nextClientID()
+			}
+			// A custom GenerateClientID must not replace a live connection
+			if h.taken(req.client) {
+				h.tinySSE.warn("SSE duplicate client ID rejected:", req.client.id)
+				req.reply("", nil)
+				close(req.client.send)
+				continue
+			}
+			if h.config.SingleConnectionPerUser {
+				h.replaceUserConnections(req.client)
+			}
+			h.clients[req.client.id] = req.client
+			h.tinySSE.info("SSE client connected:", req.client.id, "channels:", req.client.channels)
+			h.warnHTTP1Limit(req.client)
+			h.metrics.SetActiveClients(len(h.clients))
+			if req.lastEventID != "" {
+				h.metrics.IncReconnect()
+			}
+			req.reply(req.client.id, h.replayHistory(req.client, req.lastEventID))
+			h.announce("join", req.client)
 
 		case client := <-h.unregister:
-			if _, ok := h.clients[client]; ok {
-				delete(h.clients, client)
-				close(client.send)
+			if h.clients[client.id] == client {
+				h.remove(client, ReasonClientClosed)
 			}
 
+		case fn := <-h.exec:
+			fn()
+
+		case reply := <-h.shutdown:
+			reply <- h.closeAll()
+
 		case bMsg := <-h.broadcast:
-			// 1. Assign ID
-			bMsg.msg.ID = h.nextID()
-
-			// 2. Add to history
-			h.addToHistory(bMsg.msg, bMsg.channels)
-
-			// 3. Format message once
-			formattedMsg := formatSSEMessage(bMsg.msg.ID, bMsg.msg.Event, bMsg.msg.Data)
-			dataBytes := []byte(formattedMsg)
-
-			// 4. Send to interested clients
-			for client := range h.clients {
-				if h.isSubscribed(client, bMsg.channels) {
-					select {
-					case client.send <- dataBytes:
-					default:
-						h.tinySSE.log("Dropping message for slow client")
-					}
+			if h.closed {
+				h.tinySSE.warn("Dropping message, hub is shut down")
+				if bMsg.stats != nil {
+					bMsg.stats <- DeliveryStats{}
+				}
+				continue
+			}
+
+			if bMsg.err = h.checkSender(bMsg.sender); bMsg.err == nil {
+				bMsg.err = h.checkSize(bMsg.msg)
+			}
+			if bMsg.err != nil {
+				if bMsg.stats != nil {
+					bMsg.stats <- DeliveryStats{}
+				}
+				continue
+			}
+
+			h.dispatch(bMsg)
+		}
+	}
+}
+
+// checkSender applies PerClientRateLimit to the client that caused a
+// message. Over-limit messages are counted as dropped.
+func (h *hub) checkSender(sender string) error {
+	if sender == "" {
+		return nil
+	}
+	client, ok := h.clients[sender]
+	if !ok {
+		return ErrClientNotFound
+	}
+	if h.config.PerClientRateLimit > 0 && !client.limiter.allow(h.config.PerClientRateLimit, time.Now()) {
+		h.tinySSE.warn("SSE rate limit exceeded by client:", sender)
+		h.metrics.IncDropped()
+		return ErrRateLimited
+	}
+	return nil
+}
+
+// checkSize applies MaxMessageSize before a message is stored or sent:
+// oversized data is truncated with TruncateOversized, otherwise the
+// message is rejected and counted as dropped.
+func (h *hub) checkSize(msg *SSEMessage) error {
+	limit := h.config.MaxMessageSize
+	if limit <= 0 || len(msg.Data) <= limit {
+		return nil
+	}
+	if h.config.TruncateOversized {
+		h.tinySSE.warn("SSE message truncated to MaxMessageSize:", len(msg.Data), ">", limit)
+		msg.Data = msg.Data[:limit]
+		return nil
+	}
+	h.tinySSE.warn("SSE message rejected, exceeds MaxMessageSize:", len(msg.Data), ">", limit)
+	h.metrics.IncDropped()
+	return ErrMessageTooLarge
+}
+
+// dispatch assigns an ID to a message, stores it and sends it to its targets.
+// It only runs on the hub goroutine, so every client's send channel gets
+// messages in ID order however many goroutines publish concurrently
+// (PriorityHigh messages excepted, as they use their own lane).
+func (h *hub) dispatch(bMsg *broadcastMessage) {
+	ctx := bMsg.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	h.dispatching = true
+
+	// 1. Assign ID, resolving ChannelGroups so history keeps the members
+	bMsg.target.Channels = h.config.expandGroups(bMsg.target.Channels)
+	bMsg.msg.ID = h.nextID(bMsg.msg)
+	bMsg.msg.Timestamp = time.Now()
+	h.metrics.IncBroadcast()
+
+	// 2. Add to history and share with the other nodes
+	h.addToHistory(bMsg.msg, bMsg.target, bMsg.key)
+	if !bMsg.remote {
+		h.bus.Publish(BusMessage{Message: *bMsg.msg, Target: bMsg.target, Key: bMsg.key, Origin: h.nodeID})
+	}
+
+	// 3. Format message once (per client when middleware may change it)
+	formattedMsg := h.format(bMsg.msg)
+	dataBytes := []byte(formattedMsg)
+
+	// 4. Send to interested clients
+	var stats DeliveryStats
+	for _, client := range h.clients {
+		if h.isTarget(client, bMsg.target) && h.mayDeliver(client, bMsg.target) {
+			stats.Matched++
+			if len(h.config.Middleware) > 0 {
+				var ok bool
+				if dataBytes, ok = h.render(client, bMsg.msg); !ok {
+					continue // Filtered out for this client
+				}
+			}
+			if bMsg.key != "" {
+				h.dropPending(client, bMsg.key)
+			}
+			queued := false
+			if client.paused {
+				// Queued until Resume; not counted as delivered yet
+				queued = true
+				if h.queuePaused(client, dataBytes) {
+					stats.Dropped++
+					h.metrics.IncDropped()
+				}
+			} else {
+				delivered, full := h.send(ctx, client, client.lane(bMsg.msg.Priority), dataBytes)
+				if delivered {
+					queued = true
+					stats.Delivered++
 				}
+				if full {
+					stats.Dropped++
+					h.metrics.IncDropped()
+				}
+				h.trackSlowClient(client, full)
+			}
+			if bMsg.key != "" && queued {
+				client.latest.set(bMsg.key, dataBytes)
 			}
+			if bMsg.ack {
+				h.trackUnacked(client, bMsg.msg)
+			}
+		}
+		if bMsg.err = ctx.Err(); bMsg.err != nil {
+			break // Already delivered messages stay delivered
+		}
+	}
+	h.notifyPollers(bMsg)
+	if bMsg.stats != nil {
+		bMsg.stats <- stats
+	}
+
+	h.dispatching = false
+	for len(h.announcements) > 0 {
+		next := h.announcements[0]
+		h.announcements = h.announcements[1:]
+		h.dispatch(next)
+	}
+}
+
+// remove unregisters a client, closes its send channel and discards the
+// messages still queued on it, so they are not written to a stream that is
+// going away: a client reconnecting with the same ID gets them once, from
+// replay, instead of interleaved duplicates.
+func (h *hub) remove(client *clientConnection, reason DisconnectReason) {
+	delete(h.clients, client.id)
+	close(client.send)
+	for range client.send {
+	}
+	for len(client.high) > 0 {
+		<-client.high
+	}
+	h.metrics.SetActiveClients(len(h.clients))
+	h.announce("leave", client)
+	h.forgetUnacked(client, reason)
+	h.notifyDisconnect(client, reason)
+}
+
+// http1ConnLimit is the per-domain connection limit of most browsers
+// over HTTP/1.1.
+const http1ConnLimit = 6
+
+// warnHTTP1Limit warns when a host reaches the browser connection limit
+// over HTTP/1.1: further tabs of that browser will hang.
+func (h *hub) warnHTTP1Limit(client *clientConnection) {
+	if client.http1Host == "" {
+		return
+	}
+	n := 0
+	for _, c := range h.clients {
+		if c.http1Host == client.http1Host {
+			n++
+		}
+	}
+	if n >= http1ConnLimit {
+		h.tinySSE.warn("SSE", n, "HTTP/1.1 connections from", client.http1Host,
+			"- browsers allow ~6 per domain; serve SSE over HTTP/2 to lift the limit")
+	}
+}
+
+// notifyDisconnect logs a removal and calls ServerConfig.OnDisconnect off
+// the hub goroutine.
+func (h *hub) notifyDisconnect(client *clientConnection, reason DisconnectReason) {
+	h.tinySSE.info("SSE client disconnected:", client.id, "reason:", reason.String())
+	if h.config.OnDisconnect != nil {
+		go h.config.OnDisconnect(client.id, reason)
+	}
+}
+
+// trackSlowClient evicts a client whose buffer has stayed full for
+// SlowClientTimeout. full reports whether the last send dropped a message.
+func (h *hub) trackSlowClient(client *clientConnection, full bool) {
+	if !full {
+		client.fullSince = time.Time{}
+		return
+	}
+	if client.fullSince.IsZero() {
+		client.fullSince = time.Now()
+		return
+	}
+	if h.config.SlowClientTimeout > 0 && time.Since(client.fullSince) >= h.config.SlowClientTimeout {
+		h.tinySSE.warn("SSE evicting slow client:", client.id)
+		h.remove(client, ReasonSlowClient)
+	}
+}
+
+// replaceUserConnections closes every existing connection of the new
+// client's user. Registers are handled one at a time by the hub goroutine,
+// so when two connects of the same user arrive together the one registered
+// last wins and the other is closed right after it was registered.
+func (h *hub) replaceUserConnections(client *clientConnection) {
+	if client.userID == "" {
+		return
+	}
+	for _, old := range h.clients {
+		if old.userID == client.userID {
+			old.farewell = []byte(": replaced\n\n")
+			h.remove(old, ReasonReplaced)
+		}
+	}
+}
+
+// taken reports whether the client's ID belongs to a live connection that
+// it will not replace under SingleConnectionPerUser.
+func (h *hub) taken(client *clientConnection) bool {
+	old, ok := h.clients[client.id]
+	if !ok {
+		return false
+	}
+	return !h.config.SingleConnectionPerUser || client.userID == "" || old.userID != client.userID
+}
+
+// presence is the payload published to PresenceChannel.
+type presence struct {
+	Event    string `json:"event"`
+	UserID   string `json:"userID"`
+	ClientID string `json:"clientID"`
+}
+
+// announce publishes a join/leave message to PresenceChannel, if configured.
+func (h *hub) announce(event string, client *clientConnection) {
+	if h.config.PresenceChannel == "" {
+		return
+	}
+	data, _ := json.Marshal(presence{Event: event, UserID: client.userID, ClientID: client.id})
+	bMsg := &broadcastMessage{
+		msg:    &SSEMessage{Data: data},
+		target: Target{Channels: []string{h.config.PresenceChannel}},
+	}
+	if h.dispatching {
+		// A client evicted mid-dispatch (trackSlowClient): announcing it
+		// now would deliver the leave before the message being sent
+		h.announcements = append(h.announcements, bMsg)
+		return
+	}
+	h.dispatch(bMsg)
+}
+
+// noopMetrics is the default Metrics implementation.
+type noopMetrics struct{}
+
+func (noopMetrics) IncBroadcast()          {}
+func (noopMetrics) IncDropped()            {}
+func (noopMetrics) IncReconnect()          {}
+func (noopMetrics) SetActiveClients(n int) {}
+func (noopMetrics) ObserveReplay(int)      {}
+func (noopMetrics) SetHistoryLength(int)   {}
+
+// isFull reports whether MaxClients has been reached.
+func (h *hub) isFull() bool {
+	return h.config.MaxClients > 0 && len(h.clients) >= h.config.MaxClients
+}
+
+// do runs fn on the hub goroutine and waits for it to finish.
+func (h *hub) do(fn func()) {
+	done := make(chan struct{})
+	h.exec <- func() {
+		fn()
+		close(done)
+	}
+	<-done
+}
+
+// closeAll stops the hub from accepting clients and messages, sends a final
+// close comment to every client and closes their send channels. Messages
+// already queued are still flushed by each handler before it returns.
+func (h *hub) closeAll() []*clientConnection {
+	h.closed = true
+	closing := make([]*clientConnection, 0, len(h.clients))
+	for id, client := range h.clients {
+		select {
+		case client.send <- []byte(": close\n\n"):
+		default:
+		}
+		close(client.send)
+		delete(h.clients, id)
+		closing = append(closing, client)
+		h.notifyDisconnect(client, ReasonShutdown)
+	}
+	h.metrics.SetActiveClients(0)
+	return closing
+}
+
+// send queues data on one of the client's lanes following the configured
+// BackpressurePolicy. full reports whether the client's buffer was full and a message was dropped.
+func (h *hub) send(ctx context.Context, client *clientConnection, lane chan []byte, data []byte) (delivered, full bool) {
+	select {
+	case lane <- data:
+		return true, false
+	default:
+	}
+
+	switch h.config.BackpressurePolicy {
+	case Block:
+		select {
+		case lane <- data:
+			return true, false
+		case <-client.done:
+			return false, false
+		case <-ctx.Done():
+			return false, false
+		}
+
+	case DropOldest:
+		select {
+		case old := <-lane:
+			client.latest.superseded(old) // Never written: forget it
+		default:
+		}
+		h.tinySSE.debug("Dropping oldest message for slow client:", client.id)
+		select {
+		case lane <- data:
+			return true, true
+		default:
+			return false, true
 		}
+
+	default: // DropNewest
+		h.tinySSE.debug("Dropping message for slow client:", client.id)
+		return false, true
+	}
+}
+
+// lane returns the channel a message of the given priority is queued on.
+func (c *clientConnection) lane(p Priority) chan []byte {
+	if p >= PriorityHigh && c.high != nil {
+		return c.high
 	}
+	return c.send
 }
 
-func (h *hub) nextID() string {
-	h.lastID++
-	return Convert(h.lastID).String()
+// nextID returns the ID of the next message: ServerConfig.IDFormat of the
+// sequence if set, otherwise the sequence in decimal.
+func (h *hub) nextID(msg *SSEMessage) string {
+	h.lastSeq++
+	if h.config.IDFormat != nil {
+		h.lastMsgID = h.config.IDFormat(h.lastSeq, msg)
+	} else {
+		h.lastMsgID = Convert(h.lastSeq).String()
+	}
+	return h.lastMsgID
 }
 
-func (h *hub) addToHistory(msg *SSEMessage, channels []string) {
-	if h.config.HistoryReplayBuffer <= 0 {
+// nextClientID returns ServerConfig.GenerateClientID() if set, otherwise
+// a random UUID, so IDs can't be guessed to target other connections.
+// Servers from NewTestServer count instead ("1", "2", ...).
+func (h *hub) nextClientID() string {
+	if h.config.GenerateClientID != nil {
+		return h.config.GenerateClientID()
+	}
+	if h.counterIDs {
+		return Convert(int(h.lastClientID.Add(1))).String()
+	}
+	return randomID()
+}
+
+// randomID returns a random version 4 UUID.
+func randomID() string {
+	var b [16]byte
+	crand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40 // Version 4
+	b[8] = b[8]&0x3f | 0x80 // RFC 4122 variant
+	h := hex.EncodeToString(b[:])
+	return h[:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:]
+}
+
+func (h *hub) addToHistory(msg *SSEMessage, t Target, key string) {
+	if h.config.historyCapacity() <= 0 {
 		return
 	}
-	h.historyMutex.Lock()
-	defer h.historyMutex.Unlock()
 
-	item := &historyItem{
-		msg:      msg,
-		channels: channels,
+	h.history.Append(HistoryEntry{
+		Message: *msg,
+		Target:  t,
+		Key:     key,
+		Created: time.Now(),
+	})
+
+	// Lazy trim of expired entries (history is in creation order)
+	keep := h.config.historyCapacity()
+	if h.config.HistoryTTL > 0 {
+		entries := h.history.Since("")
+		expired := 0
+		for expired < len(entries) && h.isExpired(entries[expired]) {
+			expired++
+		}
+		if n := len(entries) - expired; n < keep {
+			keep = n
+		}
+	}
+	h.trimHistory(keep)
+	h.trimChannels()
+	h.metrics.SetHistoryLength(h.historyLen())
+}
+
+// historyLen returns the number of history entries, without copying them
+// when the store can tell.
+func (h *hub) historyLen() int {
+	if store, ok := h.history.(interface{ Len() int }); ok {
+		return store.Len()
+	}
+	return len(h.history.Since(""))
+}
+
+// trimChannels enforces ChannelRetention: walking from the newest entry,
+// each retention bucket keeps its own limit and older entries are removed.
+func (h *hub) trimChannels() {
+	remover, ok := h.history.(HistoryRemover)
+	if !ok || len(h.config.ChannelRetention) == 0 {
+		return
 	}
 
-	h.history = append(h.history, item)
-	if len(h.history) > h.config.HistoryReplayBuffer {
-		h.history = h.history[1:] // Remove oldest
+	entries := h.history.Since("")
+	counts := make(map[string]int)
+	var drop []string
+	for i := len(entries) - 1; i >= 0; i-- {
+		bucket, limit := h.config.retentionOf(entries[i].Target)
+		counts[bucket]++
+		if counts[bucket] > limit {
+			drop = append(drop, entries[i].Message.ID)
+			h.noteTrimmed(bucket, entries[i])
+		}
+	}
+	if len(drop) > 0 {
+		remover.Remove(drop...)
 	}
 }
 
-func (h *hub) replayHistory(client *clientConnection, lastEventID string) {
-	if lastEventID == "" || h.config.HistoryReplayBuffer <= 0 {
+// trimHistory trims the history to max entries, noting the dropped ones.
+func (h *hub) trimHistory(max int) {
+	if h.historyLen() <= max {
 		return
 	}
+	before := h.history.Since("")
+	h.history.Trim(max)
+	kept := make(map[string]bool)
+	oldest := int(h.lastSeq) + 1
+	for _, entry := range h.history.Since("") {
+		kept[entry.Message.ID] = true
+		if seq := h.seqOf(entry.Message.ID); seq >= 0 && seq < oldest {
+			oldest = seq
+		}
+	}
+	for _, entry := range before {
+		if !kept[entry.Message.ID] {
+			h.noteTrimmed("", entry)
+		}
+	}
+	h.pruneUnacked(oldest)
+}
+
+// noteTrimmed records that entry was dropped from the bucket's history.
+func (h *hub) noteTrimmed(bucket string, entry HistoryEntry) {
+	if seq := h.seqOf(entry.Message.ID); seq > h.trimmed[bucket] {
+		h.trimmed[bucket] = seq
+	}
+}
+
+// trimmedSince reports whether an entry the client may have received was
+// dropped from history after sequence seq.
+func (h *hub) trimmedSince(client *clientConnection, seq int) bool {
+	if h.trimmed[""] > seq {
+		return true
+	}
+	for _, channel := range client.channels {
+		if h.trimmed[channel] > seq {
+			return true
+		}
+	}
+	return false
+}
+
+// closeDone closes done once, releasing any send blocked on the client.
+func (c *clientConnection) closeDone() {
+	c.doneOnce.Do(func() { close(c.done) })
+}
+
+// isExpired reports whether a history entry is older than HistoryTTL.
+func (h *hub) isExpired(entry HistoryEntry) bool {
+	return h.config.HistoryTTL > 0 && time.Since(entry.Created) > h.config.HistoryTTL
+}
+
+// replayHistory returns the frames a registering client is owed: its
+// unacked messages, then a gap event if needed and the history since
+// lastEventID.
+func (h *hub) replayHistory(client *clientConnection, lastEventID string) [][]byte {
+	frames, resent := h.resendUnacked(client)
+	msgs, gap := h.messagesSince(client, lastEventID)
+	if gap {
+		frames = append(frames, []byte(formatGapEvent(lastEventID)))
+	}
+	replayed := 0
+	for _, msg := range msgs {
+		if resent[msg.ID] {
+			continue
+		}
+		if data, ok := h.render(client, msg); ok {
+			frames = append(frames, data)
+			replayed++
+		}
+	}
+	if lastEventID != "" {
+		h.metrics.ObserveReplay(replayed)
+	}
+	return frames
+}
+
+// messagesSince returns the history messages published after lastEventID
+// that target the client, sorted by sequence, so a reconnecting client
+// never replays messages for channels it is not subscribed to.
+// gap reports that some of those messages are not replayed: a message
+// after lastEventID was trimmed (or lastEventID is unknown), a targeted
+// entry expired, or there are more than MaxReplayMessages.
+func (h *hub) messagesSince(client *clientConnection, lastEventID string) (msgs []*SSEMessage, gap bool) {
+	if lastEventID == "" || h.config.historyCapacity() <= 0 {
+		return nil, false
+	}
+
+	var entries []HistoryEntry
+	if seq := h.seqOf(lastEventID); seq >= 0 && uint64(seq) <= h.lastSeq {
+		// Compare sequences: lastEventID itself may have been removed
+		for _, entry := range h.history.Since("") {
+			if h.seqOf(entry.Message.ID) > seq {
+				entries = append(entries, entry)
+			}
+		}
+		gap = h.trimmedSince(client, seq)
+	} else if entries = h.history.Since(lastEventID); len(entries) == 0 && lastEventID != h.lastMsgID {
+		// Unknown ID: replay whatever is still available after the gap
+		gap = true
+		entries = h.history.Since("")
+	}
 
-	h.historyMutex.RLock()
-	defer h.historyMutex.RUnlock()
+	var targeted []HistoryEntry
+	for _, entry := range entries {
+		// Check subscription for historical messages
+		if !h.isTarget(client, entry.Target) || !h.mayDeliver(client, entry.Target) {
+			continue
+		}
+		if h.isExpired(entry) {
+			gap = true
+			continue
+		}
+		targeted = append(targeted, entry)
+	}
+
+	targeted = latestOnly(h.sortEntries(targeted))
+	if max := h.config.MaxReplayMessages; max > 0 && len(targeted) > max {
+		gap = true
+		targeted = targeted[len(targeted)-max:]
+	}
+	for _, entry := range targeted {
+		msg := entry.Message
+		msgs = append(msgs, &msg)
+	}
+	return msgs, gap
+}
+
+// sortEntries sorts history entries by sequence: custom HistoryStores are
+// not required to keep insertion order.
+func (h *hub) sortEntries(entries []HistoryEntry) []HistoryEntry {
+	sort.SliceStable(entries, func(i, j int) bool {
+		return h.seqOf(entries[i].Message.ID) < h.seqOf(entries[j].Message.ID)
+	})
+	return entries
+}
 
-	// Find where to start
-	startIndex := -1
-	for i, item := range h.history {
-		if item.msg.ID == lastEventID {
-			startIndex = i + 1
-			break
+// seqOf returns the sequence of a message ID, parsed with
+// ServerConfig.IDParse if set. IDs that don't parse sort first, in place.
+func (h *hub) seqOf(id string) int {
+	if h.config.IDParse != nil {
+		seq, err := h.config.IDParse(id)
+		if err != nil {
+			return -1
 		}
+		return int(seq)
+	}
+	n, err := Convert(id).Int()
+	if err != nil {
+		return -1
 	}
+	return n
+}
 
-	if startIndex != -1 && startIndex < len(h.history) {
-		for i := startIndex; i < len(h.history); i++ {
-			item := h.history[i]
-			// Check subscription for historical messages
-			if h.isSubscribed(client, item.channels) {
-				formattedMsg := formatSSEMessage(item.msg.ID, item.msg.Event, item.msg.Data)
-				client.send <- []byte(formattedMsg)
+func (h *hub) isTarget(client *clientConnection, t Target) bool {
+	for _, id := range t.Exclude {
+		if client.id == id {
+			return false
+		}
+	}
+	if t.All {
+		return true
+	}
+	if t.ClientID != "" {
+		return client.id == t.ClientID
+	}
+	if t.UserID != "" {
+		return client.userID == t.UserID
+	}
+	if t.Role != "" {
+		return client.role == t.Role
+	}
+	return h.isSubscribed(client, t.Channels)
+}
+
+// mayDeliver re-checks ServerConfig.AuthorizeDelivery for a channel
+// message: the client gets it if any of its channels reached by the
+// target is still authorized. Other targets are always delivered.
+func (h *hub) mayDeliver(client *clientConnection, t Target) bool {
+	if h.config.AuthorizeDelivery == nil || t.All || t.ClientID != "" || t.UserID != "" || t.Role != "" {
+		return true
+	}
+	for _, msgChan := range t.Channels {
+		for _, clientChan := range client.channels {
+			if channelMatches(msgChan, clientChan, h.config.ChannelDelimiter) && h.config.AuthorizeDelivery(client.id, clientChan) {
+				return true
 			}
 		}
 	}
+	return false
 }
 
 func (h *hub) isSubscribed(client *clientConnection, messageChannels []string) bool {
@@ -164,7 +942,7 @@ func (h *hub) isSubscribed(client *clientConnection, messageChannels []string) b
 
 	for _, msgChan := range messageChannels {
 		for _, clientChan := range client.channels {
-			if msgChan == clientChan {
+			if channelMatches(msgChan, clientChan, h.config.ChannelDelimiter) {
 				return true
 			}
 		}
@@ -172,27 +950,107 @@ func (h *hub) isSubscribed(client *clientConnection, messageChannels []string) b
 	return false
 }
 
+// channelMatches reports whether a message sent to target reaches a client
+// subscribed to channel. A trailing "*" in target matches any channel with
+// that prefix ("user:*" reaches "user:123"). Wildcards only apply to
+// targets: a client subscribed to "user:*" only gets messages sent to
+// exactly "user:*".
+// With a delimiter, a subscription also receives its subtopics: "room"
+// gets "room.lobby" and "room.lobby.chat" when delimiter is ".".
+func channelMatches(target, channel, delimiter string) bool {
+	if n := len(target); n > 0 && target[n-1] == '*' {
+		return HasPrefix(channel, target[:n-1])
+	}
+	if target == channel {
+		return true
+	}
+	return delimiter != "" && HasPrefix(target, channel+delimiter)
+}
+
+// render runs ServerConfig.Middleware for a client on a copy of msg and
+// formats the result. ok is false if a middleware dropped it.
+func (h *hub) render(client *clientConnection, msg *SSEMessage) (data []byte, ok bool) {
+	if len(h.config.Middleware) > 0 {
+		m := *msg
+		msg = &m
+		info := client.info()
+		for _, mw := range h.config.Middleware {
+			if msg, ok = mw(info, msg); !ok || msg == nil {
+				return nil, false
+			}
+		}
+	}
+	return []byte(h.format(msg)), true
+}
+
+// info describes the client to middleware. Slices and maps are shared
+// with the connection, so they must be treated as read-only.
+func (c *clientConnection) info() ClientInfo {
+	return ClientInfo{
+		ID:       c.id,
+		UserID:   c.userID,
+		Role:     c.role,
+		Channels: c.channels,
+		Metadata: c.metadata,
+	}
+}
+
+// format renders msg for the wire, base64-encoding Data when
+// Config.BinaryEncoding is set. History keeps the raw Data.
+func (h *hub) format(msg *SSEMessage) string {
+	if h.tinySSE.config.BinaryEncoding {
+		encoded := *msg
+		encoded.Data = []byte(base64.StdEncoding.EncodeToString(msg.Data))
+		msg = &encoded
+	}
+	if !h.config.EmitTimestamp && !msg.Timestamp.IsZero() {
+		plain := *msg
+		plain.Timestamp = time.Time{}
+		msg = &plain
+	}
+	return formatSSEMessage(msg)
+}
+
+// formatGapEvent tells a reconnecting client that messages after
+// lastEventID were lost. It has no id: field, so the client's
+// Last-Event-ID is left untouched.
+func formatGapEvent(lastEventID string) string {
+	return "event: " + GapEvent + "\ndata: " + lastEventID + "\n\n"
+}
+
 // formatSSEMessage formats the SSE message according to spec.
 // Handles newlines by creating multiple data: lines.
-func formatSSEMessage(id, event string, data []byte) string {
+func formatSSEMessage(msg *SSEMessage) string {
 	b := Convert()
 	b.Write("id: ")
-	b.Write(id)
+	b.Write(msg.ID)
 	b.Write("\n")
 
-	if event != "" {
+	if msg.Event != "" {
 		b.Write("event: ")
-		b.Write(event)
+		b.Write(msg.Event)
+		b.Write("\n")
+	}
+
+	if msg.Retry > 0 {
+		b.Write("retry: ")
+		b.Write(msg.Retry)
+		b.Write("\n")
+	}
+
+	if !msg.Timestamp.IsZero() {
+		b.Write("time: ")
+		b.Write(msg.Timestamp.UnixMilli())
 		b.Write("\n")
 	}
 
 	// Split data by \n (also handles \r\n if we split by \n and trim \r)
-	lines := bytes.Split(data, []byte("\n"))
+	lines := bytes.Split(msg.Data, []byte("\n"))
 	for _, line := range lines {
 		// Remove trailing \r if present
 		line = bytes.TrimSuffix(line, []byte("\r"))
 		b.Write("data: ")
-		b.Write(line)
+		b.Write(string(line))
 		b.Write("\n")
 	}
 
@@ -2,7 +2,11 @@
 
 package sse
 
-import "net/http"
+import (
+	"net/http"
+
+	. "github.com/tinywasm/fmt"
+)
 
 // ChannelProvider resolves SSE channels for a connection.
 // Implemented by external packages (e.g., crudp session handler).
@@ -19,6 +23,110 @@ type ChannelProvider interface {
 	ResolveChannels(r *http.Request) (channels []string, err error)
 }
 
+// RequestedChannels returns the channels a client asked for with repeated
+// "channel" query params (ClientConfig.Channels), already URL-decoded.
+// A ChannelProvider may use it, but should only grant channels the
+// connection is allowed to see.
+func RequestedChannels(r *http.Request) []string {
+	return r.URL.Query()["channel"]
+}
+
+// BearerToken returns the token sent with "Authorization: Bearer <token>"
+// (ClientConfig.Headers) or, since native EventSource can't send headers,
+// the "token" query param. Empty if neither is present.
+// Validate it in ResolveChannels: an error there rejects the connection
+// with 401 before it is registered.
+func BearerToken(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); HasPrefix(auth, "Bearer ") {
+		return auth[len("Bearer "):]
+	}
+	return r.URL.Query().Get("token")
+}
+
+// UserProvider resolves the application user behind an SSE connection.
+// Optional: only needed to target messages with SendToUser.
+type UserProvider interface {
+	// ResolveUser returns the user ID for the connection.
+	// Called once when client connects, after ResolveChannels succeeds.
+	// An empty ID means the connection is anonymous.
+	ResolveUser(r *http.Request) (userID string)
+}
+
+// RoleProvider resolves the role of the user behind an SSE connection.
+// Optional: only needed to target messages with SendToRole.
+type RoleProvider interface {
+	// ResolveRole returns the role for the connection (e.g., "admin").
+	// Called once when client connects, after ResolveChannels succeeds.
+	ResolveRole(r *http.Request) (role string)
+}
+
+// MetadataProvider attaches arbitrary attributes to an SSE connection
+// (e.g., device type, app version), read from query params or headers.
+type MetadataProvider interface {
+	// ResolveMetadata returns the initial metadata for the connection.
+	// Called once when client connects, after ResolveChannels succeeds.
+	ResolveMetadata(r *http.Request) map[string]string
+}
+
+// Metrics receives hub counters so they can be exported to Prometheus
+// or any other monitoring system. Calls are made from the hub goroutine.
+type Metrics interface {
+	// IncBroadcast counts every message published.
+	IncBroadcast()
+	// IncDropped counts every message a slow client did not receive,
+	// every PublishFrom message rejected by PerClientRateLimit, and every
+	// message rejected by MaxMessageSize.
+	IncDropped()
+	// IncReconnect counts connections that resumed with a Last-Event-ID.
+	IncReconnect()
+	// SetActiveClients reports the number of connected clients.
+	SetActiveClients(n int)
+	// ObserveReplay is called once per connection that resumed with a
+	// Last-Event-ID, with the number of history messages replayed to it.
+	// Count calls and sum messages to size HistoryReplayBuffer.
+	ObserveReplay(messages int)
+	// SetHistoryLength reports the number of entries in the replay
+	// history after each publish, to watch its memory use.
+	SetHistoryLength(n int)
+}
+
+// HistoryStore keeps published messages for Last-Event-ID replay.
+// The default is an in-memory store; implement this to persist history
+// (e.g., Redis or a file) across restarts. Must be safe for concurrent use.
+type HistoryStore interface {
+	// Append stores an entry. Entries are appended in ID order.
+	Append(entry HistoryEntry)
+
+	// Since returns the entries stored after lastEventID, oldest first.
+	// An empty lastEventID returns every entry; an unknown one returns nil.
+	Since(lastEventID string) []HistoryEntry
+
+	// Trim discards the oldest entries so at most max remain.
+	Trim(max int)
+}
+
+// HistoryRemover is implemented by a HistoryStore that can discard single
+// entries. ServerConfig.ChannelRetention needs it; with a store lacking it
+// only the combined buffer size is enforced. The default store implements it.
+type HistoryRemover interface {
+	// Remove discards the entries with the given message IDs.
+	Remove(ids ...string)
+}
+
+// BusAdapter connects the hubs of several server instances (e.g., over
+// Redis pub/sub or NATS) so a message published on one node reaches the
+// clients connected to the others.
+type BusAdapter interface {
+	// Publish sends a locally published message to the other nodes.
+	// Called from the hub goroutine: it must not block.
+	Publish(msg BusMessage)
+
+	// Subscribe registers fn to receive the messages published by other
+	// nodes. Called once when the server is created. Messages whose
+	// Origin is this node may be passed too; they are ignored.
+	Subscribe(fn func(msg BusMessage))
+}
+
 // SSEPublisher allows publishing messages to SSE clients.
 // Implemented by sse.SSEServer.
 type SSEPublisher interface {
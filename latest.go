@@ -0,0 +1,110 @@
+//go:build !wasm
+
+package sse
+
+import "sync"
+
+// PublishLatest publishes state where only the newest value per key
+// matters (e.g., a cursor position or a stock price). A message with the
+// same key still waiting in a client's buffer (or pause queue) is replaced,
+// so slow clients skip stale intermediate states. Latest-wins also applies
+// to replay and HistorySnapshot: only the newest message per key is
+// replayed, although every one still counts against HistoryReplayBuffer.
+func (s *SSEServer) PublishLatest(key string, data []byte, channels ...string) {
+	s.hub.broadcast <- &broadcastMessage{
+		msg: &SSEMessage{
+			Data: data,
+		},
+		target: Target{Channels: channels},
+		key:    key,
+	}
+}
+
+// latestFrames tracks the frames a client was queued by PublishLatest.
+// The hub records them and the handler, when about to write one, skips it
+// if a newer frame with the same key was queued since: frames are never
+// taken back out of the buffer, so the stream keeps its order.
+type latestFrames struct {
+	mu     sync.Mutex
+	newest map[string]*byte // Newest frame queued per key
+	keys   map[*byte]string // Key of each queued frame
+}
+
+// set records data as the newest frame queued for key.
+func (l *latestFrames) set(key string, data []byte) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.newest == nil {
+		l.newest = make(map[string]*byte)
+		l.keys = make(map[*byte]string)
+	}
+	// Frames are shared by every client they are sent to: compare them
+	// by address, not content
+	l.newest[key] = &data[0]
+	l.keys[&data[0]] = key
+}
+
+// superseded reports whether data, about to be written, is a PublishLatest
+// frame replaced by a newer one. The frame is forgotten either way.
+func (l *latestFrames) superseded(data []byte) bool {
+	if len(data) == 0 {
+		return false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	key, ok := l.keys[&data[0]]
+	if !ok {
+		return false
+	}
+	delete(l.keys, &data[0])
+	if l.newest[key] != &data[0] {
+		return true
+	}
+	delete(l.newest, key)
+	return false
+}
+
+// dropPending removes from the pause queue the frame queued for key by an
+// earlier PublishLatest. Frames already in the buffer are skipped by the
+// handler instead (see latestFrames).
+func (h *hub) dropPending(client *clientConnection, key string) {
+	for i, data := range client.pending {
+		if client.latest.forget(key, data) {
+			client.pending = append(client.pending[:i], client.pending[i+1:]...)
+			return
+		}
+	}
+}
+
+// forget drops data if it is the newest frame queued for key.
+func (l *latestFrames) forget(key string, data []byte) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(data) == 0 || l.newest[key] != &data[0] {
+		return false
+	}
+	delete(l.newest, key)
+	delete(l.keys, &data[0])
+	return true
+}
+
+// latestOnly keeps only the newest entry per PublishLatest key, in order.
+// entries must be sorted oldest first.
+func latestOnly(entries []HistoryEntry) []HistoryEntry {
+	newest := make(map[string]int)
+	for i, entry := range entries {
+		if entry.Key != "" {
+			newest[entry.Key] = i
+		}
+	}
+	if len(newest) == 0 {
+		return entries
+	}
+	out := make([]HistoryEntry, 0, len(entries))
+	for i, entry := range entries {
+		if entry.Key == "" || newest[entry.Key] == i {
+			out = append(out, entry)
+		}
+	}
+	return out
+}
@@ -1,9 +1,97 @@
 package sse
 
+import (
+	"bytes"
+	"time"
+)
+
 // SSEMessage represents a message sent over SSE.
 // Shared by both Server (for broadcasting) and Client (for consumption).
 type SSEMessage struct {
 	ID    string // SSE "id:" field - Required. Used for Last-Event-ID reconnection.
 	Event string // SSE "event:" field - Optional. Allows routing to different handlers.
 	Data  []byte // SSE "data:" field - RAW bytes, library does NOT parse.
+	Retry int    // SSE "retry:" field - Optional. Reconnection delay hint in ms, sent when > 0.
+
+	// Timestamp is when the server published the message. Sent as a custom
+	// "time:" field (unix ms) when ServerConfig.EmitTimestamp is set; only the
+	// Fetch transport (ClientConfig.Headers) can read it, native EventSource
+	// drops unknown fields and leaves it zero.
+	Timestamp time.Time
+
+	// Priority is server-side only (not sent): PriorityHigh messages skip
+	// ahead of the normal ones queued for a slow client.
+	Priority Priority
+}
+
+// Priority is the delivery lane of an SSEMessage (SSEServer.PublishPriority).
+type Priority int
+
+const (
+	// PriorityNormal messages are delivered in publish order.
+	PriorityNormal Priority = iota
+	// PriorityHigh messages (e.g., "reload") are written before any queued
+	// PriorityNormal ones.
+	PriorityHigh
+)
+
+// GapEvent is sent to a reconnecting client when messages published after
+// its Last-Event-ID are no longer in the server history (trimmed or
+// expired), or that ID is unknown. Its data is that Last-Event-ID. Listen
+// with client.On(GapEvent, ...) and reload the full state instead of
+// assuming the stream is continuous. Decimal IDs restart at 1 with the
+// server, so a restart is missed once the new sequence passes the
+// client's ID: to detect restarts, make IDs unique per server run with
+// ServerConfig.IDFormat (see docs/CONFIG.md).
+const GapEvent = "reconnect-gap"
+
+// HeartbeatEvent is the event of heartbeats sent with
+// ServerConfig.HeartbeatAsEvent. Its data is empty and it has no ID, so it
+// never changes the client's Last-Event-ID.
+const HeartbeatEvent = "heartbeat"
+
+// BatchEvent is the event of messages sent by SSEServer.PublishBatched.
+// Their data holds one item per line; iterate them with BatchItems.
+const BatchEvent = "batch"
+
+// BatchItems splits the data of a BatchEvent message into its items.
+func (m *SSEMessage) BatchItems() [][]byte {
+	if len(m.Data) == 0 {
+		return nil
+	}
+	return bytes.Split(m.Data, []byte("\n"))
+}
+
+// ErrorCode classifies an SSEError so apps can decide whether to wait for
+// a reconnect, re-authenticate or show a message.
+type ErrorCode int
+
+const (
+	// CodeConnectionLost: the stream dropped; the client is reconnecting
+	// (or gave up after MaxReconnectAttempts).
+	CodeConnectionLost ErrorCode = iota
+	// CodeAuthFailed: the server rejected the connection with 401 or 403.
+	// Only the Fetch transport (ClientConfig.Headers) sees the status.
+	CodeAuthFailed
+	// CodeServerClosed: the server ended or refused the stream and the
+	// browser will not retry on its own.
+	CodeServerClosed
+	// CodeDecodeError: a message could not be decoded (e.g., invalid
+	// base64 with Config.BinaryEncoding).
+	CodeDecodeError
+)
+
+// SSEError is the error passed to the client's OnError handler.
+// Type-assert it (or use errors.As) to branch on Code.
+type SSEError struct {
+	Code ErrorCode
+	Err  error
+}
+
+func (e *SSEError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *SSEError) Unwrap() error {
+	return e.Err
 }
@@ -0,0 +1,54 @@
+//go:build !wasm
+
+package sse
+
+import "time"
+
+// Option tweaks a single setting for NewWithOptions.
+type Option func(c *Config, s *ServerConfig)
+
+// NewWithOptions builds a server from options instead of config structs.
+// It is a shortcut for New(&Config{...}).Server(&ServerConfig{...}):
+// unset values get the same defaults as ServerConfig.Validate.
+func NewWithOptions(opts ...Option) *SSEServer {
+	c, s := &Config{}, &ServerConfig{}
+	for _, opt := range opts {
+		opt(c, s)
+	}
+	return New(c).Server(s)
+}
+
+// WithLog sets Config.Log.
+func WithLog(log func(args ...any)) Option {
+	return func(c *Config, s *ServerConfig) { c.Log = log }
+}
+
+// WithChannelProvider sets ServerConfig.ChannelProvider.
+func WithChannelProvider(p ChannelProvider) Option {
+	return func(c *Config, s *ServerConfig) { s.ChannelProvider = p }
+}
+
+// WithClientBuffer sets ServerConfig.ClientChannelBuffer.
+func WithClientBuffer(n int) Option {
+	return func(c *Config, s *ServerConfig) { s.ClientChannelBuffer = n }
+}
+
+// WithHistoryBuffer sets ServerConfig.HistoryReplayBuffer.
+func WithHistoryBuffer(n int) Option {
+	return func(c *Config, s *ServerConfig) { s.HistoryReplayBuffer = n }
+}
+
+// WithHeartbeat sets ServerConfig.HeartbeatInterval.
+func WithHeartbeat(d time.Duration) Option {
+	return func(c *Config, s *ServerConfig) { s.HeartbeatInterval = d }
+}
+
+// WithAllowedOrigins sets ServerConfig.AllowedOrigins.
+func WithAllowedOrigins(origins ...string) Option {
+	return func(c *Config, s *ServerConfig) { s.AllowedOrigins = origins }
+}
+
+// WithMaxClients sets ServerConfig.MaxClients.
+func WithMaxClients(n int) Option {
+	return func(c *Config, s *ServerConfig) { s.MaxClients = n }
+}
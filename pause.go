@@ -0,0 +1,63 @@
+//go:build !wasm
+
+package sse
+
+import "context"
+
+// Pause stops delivering messages to a client without closing its stream
+// (e.g., a mobile app moved to the background). Messages are queued, up to
+// ServerConfig.MaxPausedMessages, and flushed in order by Resume. When the
+// queue is full, DropOldest discards the oldest queued message; any other
+// policy drops the new one. Returns ErrClientNotFound if not connected.
+func (s *SSEServer) Pause(clientID string) error {
+	return s.withClient(clientID, func(client *clientConnection) {
+		client.paused = true
+	})
+}
+
+// Resume flushes the messages queued while a client was paused, in order,
+// and resumes normal delivery. Queued messages that don't fit the client's
+// buffer follow the BackpressurePolicy. Returns ErrClientNotFound if not
+// connected.
+func (s *SSEServer) Resume(clientID string) error {
+	return s.withClient(clientID, func(client *clientConnection) {
+		client.paused = false
+		pending := client.pending
+		client.pending = nil
+		for _, data := range pending {
+			if _, full := s.hub.send(context.Background(), client, client.send, data); full {
+				s.hub.metrics.IncDropped()
+			}
+		}
+	})
+}
+
+// withClient runs fn on the hub goroutine with a connected client.
+func (s *SSEServer) withClient(clientID string, fn func(client *clientConnection)) error {
+	found := false
+	s.hub.do(func() {
+		if client, ok := s.hub.clients[clientID]; ok {
+			found = true
+			fn(client)
+		}
+	})
+	if !found {
+		return ErrClientNotFound
+	}
+	return nil
+}
+
+// queuePaused stores a message for a paused client and reports whether a
+// message was dropped because the queue was full.
+func (h *hub) queuePaused(client *clientConnection, data []byte) (dropped bool) {
+	if len(client.pending) < h.config.MaxPausedMessages {
+		client.pending = append(client.pending, data)
+		return false
+	}
+	if h.config.BackpressurePolicy == DropOldest {
+		client.latest.superseded(client.pending[0]) // Never written: forget it
+		client.pending = append(client.pending[1:], data)
+	}
+	h.tinySSE.debug("Dropping message for paused client:", client.id)
+	return true
+}
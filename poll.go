@@ -0,0 +1,110 @@
+//go:build !wasm
+
+package sse
+
+import (
+	"net/http"
+	"time"
+)
+
+// LongPollHandler returns a long-polling fallback for networks that block
+// streaming responses (see ClientConfig.LongPollEndpoint). Each GET, with
+// the same channel, auth and "lastEventId" params as the stream, answers
+// in the SSE format: the history messages after lastEventId (or a
+// GapEvent) right away, otherwise the first new message, waiting up to
+// LongPollTimeout. Messages published between polls are only recovered
+// from history, so pair it with HistoryReplayBuffer. Pollers are not
+// connected clients: they get no presence events and aren't counted.
+func (s *SSEServer) LongPollHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.handleCORS(w, r, http.MethodGet) {
+			return
+		}
+		channels, userID, role, ok := s.resolveRequest(w, r)
+		if !ok {
+			return
+		}
+
+		// A clientId only matters for messages sent to that client ID
+		id := r.URL.Query().Get("clientId")
+		if !s.config.AcceptClientID || !validClientID(id) {
+			id = ""
+		}
+		client := &clientConnection{
+			id:       id,
+			channels: channels,
+			send:     make(chan []byte, s.config.ClientChannelBuffer),
+			userID:   userID,
+			role:     role,
+		}
+
+		lastEventID := r.URL.Query().Get("lastEventId")
+		var frames [][]byte
+		s.hub.do(func() {
+			frames = s.hub.backlog(client, lastEventID)
+			if len(frames) == 0 {
+				s.hub.pollers[client] = struct{}{}
+			}
+		})
+		if len(frames) == 0 {
+			timer := time.NewTimer(s.config.LongPollTimeout)
+			select {
+			case data := <-client.send:
+				frames = append(frames, data)
+			case <-timer.C:
+			case <-r.Context().Done():
+			}
+			timer.Stop()
+			s.hub.do(func() {
+				delete(s.hub.pollers, client)
+			})
+			close(client.send) // Collect what arrived meanwhile
+			for data := range client.send {
+				frames = append(frames, data)
+			}
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		for _, data := range frames {
+			if _, err := w.Write(data); err != nil {
+				return
+			}
+		}
+	})
+}
+
+// backlog returns the frames a poller missed since lastEventID: a gap
+// event if some are lost, then the history messages targeting it. The gap
+// event carries the last message ID, so the next poll waits for new
+// messages instead of reporting the same gap again.
+func (h *hub) backlog(client *clientConnection, lastEventID string) [][]byte {
+	var frames [][]byte
+	msgs, gap := h.messagesSince(client, lastEventID)
+	if gap {
+		frames = append(frames, []byte("id: "+h.lastMsgID+"\n"+formatGapEvent(lastEventID)))
+	}
+	for _, msg := range msgs {
+		if data, ok := h.render(client, msg); ok {
+			frames = append(frames, data)
+		}
+	}
+	return frames
+}
+
+// notifyPollers hands a message to the waiting pollers it targets. A
+// poller whose buffer is full skips it: its next poll replays it from
+// history.
+func (h *hub) notifyPollers(bMsg *broadcastMessage) {
+	for client := range h.pollers {
+		if !h.isTarget(client, bMsg.target) || !h.mayDeliver(client, bMsg.target) {
+			continue
+		}
+		if data, ok := h.render(client, bMsg.msg); ok {
+			select {
+			case client.send <- data:
+			default:
+			}
+		}
+	}
+}
@@ -0,0 +1,27 @@
+//go:build !wasm
+
+package sse
+
+import "time"
+
+// tokenBucket limits how many messages a client may publish per second,
+// allowing bursts of up to rate messages. Only used on the hub goroutine.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// allow consumes a token if one is available at now.
+func (b *tokenBucket) allow(rate int, now time.Time) bool {
+	if b.last.IsZero() {
+		b.tokens = float64(rate)
+	} else {
+		b.tokens = min(float64(rate), b.tokens+now.Sub(b.last).Seconds()*float64(rate))
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
@@ -0,0 +1,28 @@
+//go:build !wasm
+
+package sse
+
+import (
+	"net/http"
+
+	. "github.com/tinywasm/fmt"
+)
+
+// RegisterRoutes mounts the server on mux at ServerConfig.Endpoint, and
+// AckHandler at ServerConfig.AckEndpoint when set. It returns an error,
+// mounting nothing, if Endpoint is empty or a path does not start with "/".
+func (s *SSEServer) RegisterRoutes(mux *http.ServeMux) error {
+	switch {
+	case s.config.Endpoint == "":
+		return Err("Endpoint", "required to register routes")
+	case !HasPrefix(s.config.Endpoint, "/"):
+		return Err("Endpoint", "must start with /")
+	case s.config.AckEndpoint != "" && !HasPrefix(s.config.AckEndpoint, "/"):
+		return Err("AckEndpoint", "must start with /")
+	}
+	mux.Handle(s.config.Endpoint, s)
+	if s.config.AckEndpoint != "" {
+		mux.Handle(s.config.AckEndpoint, s.AckHandler())
+	}
+	return nil
+}
@@ -3,9 +3,51 @@
 package sse
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math/rand/v2"
 	"net/http"
+	"os"
+	"time"
+
+	. "github.com/tinywasm/fmt"
 )
 
+// retryAfterFull is the Retry-After value (seconds) sent when MaxClients is reached.
+const retryAfterFull = "5"
+
+// reconnectAfterExpire is the retry: hint (ms) sent when a connection
+// reaches MaxConnectionDuration.
+const reconnectAfterExpire = "1000"
+
+// ErrClientNotFound is returned by SendToClient when no connection has the given ID.
+var ErrClientNotFound error = Err("client not found")
+
+// ErrRateLimited is returned by PublishFrom when the sender exceeds
+// ServerConfig.PerClientRateLimit.
+var ErrRateLimited error = Err("rate limit exceeded")
+
+// ErrMessageTooLarge is returned by publish methods that report errors
+// when the data exceeds ServerConfig.MaxMessageSize.
+var ErrMessageTooLarge error = Err("message exceeds MaxMessageSize")
+
+// DeliveryStats reports the outcome of sending a single message.
+type DeliveryStats struct {
+	Matched   int // Clients targeted by the message.
+	Delivered int // Clients whose send buffer accepted the message.
+	Dropped   int // Clients whose send buffer was full (see BackpressurePolicy).
+}
+
+// ClientInfo is a read-only snapshot of a connected client.
+type ClientInfo struct {
+	ID       string
+	UserID   string
+	Role     string
+	Channels []string
+	Metadata map[string]string
+}
+
 // SSEServer handles Server-Sent Events HTTP connections.
 type SSEServer struct {
 	tinySSE *tinySSE
@@ -15,6 +57,9 @@ type SSEServer struct {
 
 // Server creates a new SSEServer instance.
 func (t *tinySSE) Server(c *ServerConfig) *SSEServer {
+	if err := c.Validate(); err != nil {
+		t.error("SSE invalid server config:", err)
+	}
 	return &SSEServer{
 		tinySSE: t,
 		config:  c,
@@ -24,20 +69,19 @@ func (t *tinySSE) Server(c *ServerConfig) *SSEServer {
 
 // ServeHTTP implements the http.Handler interface.
 func (s *SSEServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	// 1. Resolve channels
-	var channels []string
-	var err error
-
-	if s.config.ChannelProvider != nil {
-		channels, err = s.config.ChannelProvider.ResolveChannels(r)
-	} else {
-		// Default behavior: reject if no provider configured
-		http.Error(w, "channel provider not configured", http.StatusInternalServerError)
+	// 0. Apply CORS and reject early when the server is full
+	if !s.handleCORS(w, r, http.MethodGet) {
+		return
+	}
+	if s.config.MaxClients > 0 && s.ClientCount() >= s.config.MaxClients {
+		w.Header().Set("Retry-After", retryAfterFull)
+		http.Error(w, "too many clients", http.StatusServiceUnavailable)
 		return
 	}
 
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusUnauthorized)
+	// 1. Resolve channels
+	channels, userID, role, ok := s.resolveRequest(w, r)
+	if !ok {
 		return
 	}
 
@@ -45,55 +89,292 @@ func (s *SSEServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "text/event-stream")
 	w.Header().Set("Cache-Control", "no-cache")
 	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no") // Stop nginx from buffering the stream
+	for key, value := range s.config.ResponseHeaders {
+		if value == "" {
+			w.Header().Del(key)
+		} else {
+			w.Header().Set(key, value)
+		}
+	}
 
 	// 3. Register client
-	flusher, ok := w.(http.Flusher)
+	flusher, ok := findFlusher(w)
 	if !ok {
-		http.Error(w, "Streaming unsupported!", http.StatusInternalServerError)
+		// Without flushing, events sit in a buffer and the stream looks dead
+		s.tinySSE.error("SSE streaming unsupported: the ResponseWriter (or a middleware wrapping it) does not implement http.Flusher or Unwrap")
+		http.Error(w, "streaming unsupported: ResponseWriter does not implement http.Flusher", http.StatusInternalServerError)
 		return
 	}
 
-	// Flush headers immediately so client knows connection is open
+	st := newStream(w, flusher, s.config.Compress && acceptsGzip(r), s.config.WriteTimeout)
+	defer st.close()
+
+	// Flush headers immediately so client knows connection is open.
+	// Registration waits until they are written, so a client that is
+	// already gone never shows up as a ghost connection.
 	w.WriteHeader(http.StatusOK)
-	flusher.Flush()
+	if err := st.flush(); err != nil || r.Context().Err() != nil {
+		s.tinySSE.debug("SSE client gone before registration")
+		return
+	}
 
-	// Create client connection
+	// Randomize the browser's native reconnect delay for this connection
+	if s.config.ConnectJitter > 0 {
+		retry := time.Second + rand.N(s.config.ConnectJitter)
+		if err := st.write([]byte("retry: " + Convert(int(retry.Milliseconds())).String() + "\n\n")); err != nil {
+			return
+		}
+	}
+
+	// Create client connection; the hub generates the ID unless suggested
+	id := r.URL.Query().Get("clientId")
+	suggested := s.config.AcceptClientID && validClientID(id)
+	if !suggested {
+		id = ""
+	}
 	client := &clientConnection{
+		id:       id,
 		channels: channels,
 		send:     make(chan []byte, s.config.ClientChannelBuffer),
+		high:     make(chan []byte, s.config.ClientChannelBuffer),
+		done:     make(chan struct{}),
+		userID:   userID,
+		role:     role,
+	}
+	if !IsHTTP2(r) {
+		client.http1Host = remoteHost(r)
+	}
+	if s.config.MetadataProvider != nil {
+		client.metadata = copyMetadata(s.config.MetadataProvider.ResolveMetadata(r))
 	}
 
-	// Handle Last-Event-ID for replay
+	// Handle Last-Event-ID for replay. Manual client reconnects can't set
+	// headers and send it as a query param instead.
 	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = r.URL.Query().Get("lastEventId")
+	}
 
+	assigned := make(chan registered, 1)
 	s.hub.register <- registerRequest{
 		client:      client,
 		lastEventID: lastEventID,
+		suggestedID: suggested,
+		assigned:    assigned,
 	}
 
 	// Ensure unregister on exit
 	defer func() {
+		client.closeDone()
 		s.hub.unregister <- client
 	}()
 
+	// Tell the client its ID (final once registered) and the server time,
+	// ahead of anything the hub queued. Rejected clients get nothing.
+	reg := <-assigned
+	if reg.id != "" {
+		if err := st.write([]byte(connectedComment(reg.id, time.Now()))); err != nil {
+			return
+		}
+	}
+
+	// Heartbeat keeps idle connections open through proxies (nil = disabled)
+	var heartbeat <-chan time.Time
+	if s.config.HeartbeatInterval > 0 {
+		ticker := time.NewTicker(s.config.HeartbeatInterval)
+		defer ticker.Stop()
+		heartbeat = ticker.C
+	}
+
+	// Lifetime limit, jittered so clients don't all reconnect at once
+	var expire <-chan time.Time
+	if s.config.MaxConnectionDuration > 0 {
+		timer := time.NewTimer(jitter(s.config.MaxConnectionDuration))
+		defer timer.Stop()
+		expire = timer.C
+	}
+
+	// Idle limit, restarted by every write
+	var idle <-chan time.Time
+	var idleTimer *time.Timer
+	if s.config.IdleTimeout > 0 && s.config.HeartbeatInterval == 0 {
+		idleTimer = time.NewTimer(s.config.IdleTimeout)
+		defer idleTimer.Stop()
+		idle = idleTimer.C
+	}
+
 	// 4. Loop to send messages
+	var lastWrite time.Time
+	write := func(msg []byte) bool {
+		if client.latest.superseded(msg) {
+			return true
+		}
+		if err := st.write(msg); err != nil {
+			s.writeFailed(client, err)
+			return false
+		}
+		lastWrite = time.Now()
+		if idleTimer != nil {
+			idleTimer.Reset(s.config.IdleTimeout)
+		}
+		return true
+	}
+	// The replay comes before anything published since registration
+	for _, data := range reg.replay {
+		if !write(data) {
+			return
+		}
+	}
 	for {
+		// High-priority messages jump ahead of the queued ones
 		select {
+		case msg := <-client.high:
+			if !write(msg) {
+				return
+			}
+			continue
+		default:
+		}
+
+		select {
+		case msg := <-client.high:
+			if !write(msg) {
+				return
+			}
 		case msg, ok := <-client.send:
 			if !ok {
+				if client.farewell != nil {
+					st.write(client.farewell)
+				}
 				return
 			}
-			_, err := w.Write(msg)
-			if err != nil {
+			if !write(msg) {
 				return
 			}
-			flusher.Flush()
+		case <-heartbeat:
+			// Only ping when no real message was sent during the last interval
+			if time.Since(lastWrite) < s.config.HeartbeatInterval {
+				continue
+			}
+			ping := []byte(": ping\n\n")
+			if s.config.HeartbeatAsEvent {
+				ping = []byte("event: " + HeartbeatEvent + "\ndata\n\n")
+			}
+			if !write(ping) {
+				return
+			}
+		case <-expire:
+			// Ask the browser to reconnect soon; it resumes from Last-Event-ID
+			st.write([]byte("retry: " + reconnectAfterExpire + "\n\n"))
+			s.evict(client, ReasonExpired)
+			return
+		case <-idle:
+			s.evict(client, ReasonIdle)
+			return
 		case <-r.Context().Done():
 			return
 		}
 	}
 }
 
+// resolveRequest resolves the channels, user and role of a connection
+// request. When the request is rejected it writes the error response and
+// returns ok false.
+func (s *SSEServer) resolveRequest(w http.ResponseWriter, r *http.Request) (channels []string, userID, role string, ok bool) {
+	if s.config.ChannelProvider == nil {
+		// Default behavior: reject if no provider configured
+		http.Error(w, "channel provider not configured", http.StatusInternalServerError)
+		return nil, "", "", false
+	}
+	channels, err := s.config.ChannelProvider.ResolveChannels(r)
+	if err != nil {
+		s.tinySSE.warn("SSE connection rejected:", err)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return nil, "", "", false
+	}
+	channels = s.config.expandGroups(channels)
+
+	if s.config.UserProvider != nil {
+		userID = s.config.UserProvider.ResolveUser(r)
+	}
+	if s.config.RoleProvider != nil {
+		role = s.config.RoleProvider.ResolveRole(r)
+	}
+
+	// Drop channels the user may not access
+	if s.config.AuthorizeChannel != nil {
+		channels = s.authorizedChannels(userID, role, channels)
+		if len(channels) == 0 {
+			http.Error(w, "no authorized channels", http.StatusForbidden)
+			return nil, "", "", false
+		}
+	}
+	return channels, userID, role, true
+}
+
+// findFlusher returns w's http.Flusher, looking through middleware
+// wrappers that expose the original writer with Unwrap (the convention
+// of http.ResponseController).
+func findFlusher(w http.ResponseWriter) (http.Flusher, bool) {
+	for {
+		if flusher, ok := w.(http.Flusher); ok {
+			return flusher, true
+		}
+		u, ok := w.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			return nil, false
+		}
+		w = u.Unwrap()
+	}
+}
+
+// writeFailed evicts a client whose write exceeded WriteTimeout; other
+// write errors mean the client went away and are handled by unregister.
+func (s *SSEServer) writeFailed(client *clientConnection, err error) {
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		return
+	}
+	s.evict(client, ReasonSlowClient)
+}
+
+// evict removes a client from its own handler. done is closed first: with
+// BackpressurePolicy Block the hub may be waiting to send to this very
+// client, and would never get to the removal otherwise.
+func (s *SSEServer) evict(client *clientConnection, reason DisconnectReason) {
+	client.closeDone()
+	s.hub.do(func() {
+		// client.id is read on the hub: registration may have replaced it
+		if s.hub.clients[client.id] == client {
+			s.tinySSE.info("SSE evicting client:", client.id, "reason:", reason.String())
+			s.hub.remove(client, reason)
+		}
+	})
+}
+
+// IsHTTP2 reports whether the request was served over HTTP/2 or later.
+// Over HTTP/1.1 browsers allow only ~6 connections per domain, so the
+// 7th SSE tab hangs until another one closes.
+func IsHTTP2(r *http.Request) bool {
+	return r.ProtoMajor >= 2
+}
+
+// remoteHost returns the client IP without the port.
+func remoteHost(r *http.Request) string {
+	host := r.RemoteAddr
+	for i := len(host) - 1; i >= 0; i-- {
+		if host[i] == ':' {
+			return host[:i]
+		}
+	}
+	return host
+}
+
+// jitter returns d plus up to 10% so expirations are spread out.
+func jitter(d time.Duration) time.Duration {
+	return d + rand.N(d/10+1)
+}
+
 // Publish implements SSEPublisher.Publish
 func (s *SSEServer) Publish(data []byte, channels ...string) {
 	s.hub.broadcast <- &broadcastMessage{
@@ -101,7 +382,35 @@ func (s *SSEServer) Publish(data []byte, channels ...string) {
 			Event: "", // Default
 			Data:  data,
 		},
-		channels: channels,
+		target: Target{Channels: channels},
+	}
+}
+
+// PublishAll sends data to every connected client, whatever its channels
+// (e.g., a maintenance notice). It is kept in history, so clients
+// reconnecting with Last-Event-ID replay it too.
+func (s *SSEServer) PublishAll(data []byte) {
+	s.hub.broadcast <- &broadcastMessage{
+		msg: &SSEMessage{
+			Data: data,
+		},
+		target: Target{All: true},
+	}
+}
+
+// PublishPriority is Publish with a delivery lane: PriorityHigh messages
+// (e.g., "reload") are written before the normal messages already queued
+// for a client, so they aren't stuck behind a backlog. Each lane has its
+// own ClientChannelBuffer. High-priority messages can arrive before
+// older normal ones, so the client's Last-Event-ID may skip those on a
+// reconnect; keep the lane for control messages.
+func (s *SSEServer) PublishPriority(level Priority, data []byte, channels ...string) {
+	s.hub.broadcast <- &broadcastMessage{
+		msg: &SSEMessage{
+			Data:     data,
+			Priority: level,
+		},
+		target: Target{Channels: channels},
 	}
 }
 
@@ -112,6 +421,389 @@ func (s *SSEServer) PublishEvent(event string, data []byte, channels ...string)
 			Event: event,
 			Data:  data,
 		},
-		channels: channels,
+		target: Target{Channels: channels},
 	}
 }
+
+// PublishJSON marshals v with encoding/json and publishes it like Publish.
+// On a marshal error nothing is published. Server-only, so the WASM client
+// stays free of encoding/json.
+func (s *SSEServer) PublishJSON(v any, channels ...string) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	s.Publish(data, channels...)
+	return nil
+}
+
+// PublishN works like Publish but waits for the message to be dispatched
+// and returns how many clients received or dropped it.
+func (s *SSEServer) PublishN(data []byte, channels ...string) DeliveryStats {
+	stats := make(chan DeliveryStats, 1)
+	s.hub.broadcast <- &broadcastMessage{
+		msg: &SSEMessage{
+			Data: data,
+		},
+		target: Target{Channels: channels},
+		stats:  stats,
+	}
+	return <-stats
+}
+
+// PublishFunc calls fn to build the payload and publishes it like Publish
+// only if a client is subscribed to one of the channels, so expensive
+// payloads are not serialized for idle channels. Skipped messages are not
+// stored in history either. Returns whether the message was published.
+func (s *SSEServer) PublishFunc(fn func() []byte, channels ...string) bool {
+	if s.subscribers(channels) == 0 {
+		return false
+	}
+	s.Publish(fn(), channels...)
+	return true
+}
+
+// PublishWithRetry sends data with a "retry:" hint telling browsers how many
+// milliseconds to wait before reconnecting (e.g., to back clients off during overload).
+func (s *SSEServer) PublishWithRetry(retry int, data []byte, channels ...string) {
+	s.hub.broadcast <- &broadcastMessage{
+		msg: &SSEMessage{
+			Data:  data,
+			Retry: retry,
+		},
+		target: Target{Channels: channels},
+	}
+}
+
+// PublishContext works like Publish but stops sending to the remaining clients
+// once ctx is cancelled, returning ctx.Err(). Clients already served keep the
+// message, and it is still stored in history.
+func (s *SSEServer) PublishContext(ctx context.Context, data []byte, channels ...string) error {
+	bMsg := &broadcastMessage{
+		msg: &SSEMessage{
+			Data: data,
+		},
+		target: Target{Channels: channels},
+		stats:  make(chan DeliveryStats, 1),
+		ctx:    ctx,
+	}
+	select {
+	case s.hub.broadcast <- bMsg:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	<-bMsg.stats
+	return bMsg.err
+}
+
+// PublishExcept sends data to clients subscribed to the specified channels,
+// skipping the clients whose IDs are in exclude (e.g., the one that triggered
+// the action). An empty exclude behaves exactly like Publish.
+func (s *SSEServer) PublishExcept(data []byte, exclude []string, channels ...string) {
+	s.hub.broadcast <- &broadcastMessage{
+		msg: &SSEMessage{
+			Data: data,
+		},
+		target: Target{Channels: channels, Exclude: exclude},
+	}
+}
+
+// PublishFrom publishes data on behalf of a connected client (e.g., a chat
+// message it posted), enforcing ServerConfig.PerClientRateLimit for that
+// client. Returns ErrRateLimited when over the limit and ErrClientNotFound
+// when senderID is not connected; the message is not published in either case.
+func (s *SSEServer) PublishFrom(senderID string, data []byte, channels ...string) error {
+	bMsg := &broadcastMessage{
+		msg: &SSEMessage{
+			Data: data,
+		},
+		target: Target{Channels: channels},
+		sender: senderID,
+		stats:  make(chan DeliveryStats, 1),
+	}
+	s.hub.broadcast <- bMsg
+	<-bMsg.stats
+	return bMsg.err
+}
+
+// PublishOptions controls how PublishWithOptions targets a message.
+type PublishOptions struct {
+	// Event is the SSE "event:" field. Empty = default "message".
+	Event string
+
+	// UserID, if set, targets every connection of that user (like
+	// SendToUser) instead of the channels.
+	UserID string
+
+	// SenderID is the connection that caused the message (e.g., posted a
+	// chat line). PerClientRateLimit applies to it, like PublishFrom.
+	SenderID string
+
+	// EchoToSender also delivers the message to SenderID. By default the
+	// sender is skipped, since it usually rendered its own message already.
+	EchoToSender bool
+}
+
+// PublishWithOptions publishes data on behalf of opts.SenderID, which by
+// default does not receive its own message while the user's other tabs
+// and other subscribers do. Returns ErrRateLimited or ErrClientNotFound
+// for the sender like PublishFrom; the message is not published then.
+func (s *SSEServer) PublishWithOptions(opts PublishOptions, data []byte, channels ...string) error {
+	target := Target{Channels: channels, UserID: opts.UserID}
+	if opts.SenderID != "" && !opts.EchoToSender {
+		target.Exclude = []string{opts.SenderID}
+	}
+	bMsg := &broadcastMessage{
+		msg: &SSEMessage{
+			Event: opts.Event,
+			Data:  data,
+		},
+		target: target,
+		sender: opts.SenderID,
+		stats:  make(chan DeliveryStats, 1),
+	}
+	s.hub.broadcast <- bMsg
+	<-bMsg.stats
+	return bMsg.err
+}
+
+// SendToUser sends data to every open connection of the given user
+// (multiple tabs/devices). It is a no-op if the user has no connections.
+func (s *SSEServer) SendToUser(userID string, data []byte) {
+	s.hub.broadcast <- &broadcastMessage{
+		msg: &SSEMessage{
+			Data: data,
+		},
+		target: Target{UserID: userID},
+	}
+}
+
+// SendToRole sends data to every connection whose role matches exactly
+// (case-sensitive).
+func (s *SSEServer) SendToRole(role string, data []byte) {
+	s.hub.broadcast <- &broadcastMessage{
+		msg: &SSEMessage{
+			Data: data,
+		},
+		target: Target{Role: role},
+	}
+}
+
+// SendToClient sends data to a single connection identified by its client ID.
+// Returns ErrClientNotFound if that connection is no longer registered.
+func (s *SSEServer) SendToClient(clientID string, data []byte) error {
+	bMsg := &broadcastMessage{
+		msg: &SSEMessage{
+			Data: data,
+		},
+		target: Target{ClientID: clientID},
+		stats:  make(chan DeliveryStats, 1),
+	}
+	s.hub.broadcast <- bMsg
+	if (<-bMsg.stats).Matched == 0 && bMsg.err == nil {
+		return ErrClientNotFound
+	}
+	return bMsg.err
+}
+
+// Shutdown stops accepting new connections and messages, sends a final
+// close comment to every client and waits for their streams to flush.
+// Returns ctx.Err() if the context ends before all clients are drained.
+func (s *SSEServer) Shutdown(ctx context.Context) error {
+	reply := make(chan []*clientConnection, 1)
+	select {
+	case s.hub.shutdown <- reply:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	for _, client := range <-reply {
+		select {
+		case <-client.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// ClientCount returns the number of connected clients.
+func (s *SSEServer) ClientCount() int {
+	var n int
+	s.hub.do(func() {
+		n = len(s.hub.clients)
+	})
+	return n
+}
+
+// ChannelSubscribers returns how many connected clients a Publish to
+// channel would reach (wildcards and ChannelDelimiter apply), e.g. to skip
+// computing an expensive payload nobody will receive.
+func (s *SSEServer) ChannelSubscribers(channel string) int {
+	return s.subscribers([]string{channel})
+}
+
+// subscribers counts the clients subscribed to any of channels (or of
+// their ChannelGroups members).
+func (s *SSEServer) subscribers(channels []string) int {
+	channels = s.config.expandGroups(channels)
+	var n int
+	s.hub.do(func() {
+		for _, client := range s.hub.clients {
+			if s.hub.isSubscribed(client, channels) {
+				n++
+			}
+		}
+	})
+	return n
+}
+
+// HasSubscribers reports whether any connected client is subscribed to channel.
+func (s *SSEServer) HasSubscribers(channel string) bool {
+	return s.ChannelSubscribers(channel) > 0
+}
+
+// Clients returns a snapshot of the connected clients.
+// The returned values are copies and safe to keep or modify.
+func (s *SSEServer) Clients() []ClientInfo {
+	var list []ClientInfo
+	s.hub.do(func() {
+		list = make([]ClientInfo, 0, len(s.hub.clients))
+		for _, c := range s.hub.clients {
+			list = append(list, ClientInfo{
+				ID:       c.id,
+				UserID:   c.userID,
+				Role:     c.role,
+				Channels: append([]string(nil), c.channels...),
+				Metadata: copyMetadata(c.metadata),
+			})
+		}
+	})
+	return list
+}
+
+// Disconnect forcibly closes a client's stream (e.g., an admin kick).
+// Returns false if no client with that ID is connected.
+func (s *SSEServer) Disconnect(clientID string) bool {
+	return s.DisconnectWithReason(clientID, ReasonDisconnected)
+}
+
+// DisconnectWithReason works like Disconnect but reports reason to
+// OnDisconnect, e.g. ReasonAuthRevoked when the user logs out.
+func (s *SSEServer) DisconnectWithReason(clientID string, reason DisconnectReason) bool {
+	var found bool
+	s.hub.do(func() {
+		client, ok := s.hub.clients[clientID]
+		if !ok {
+			return
+		}
+		found = true
+		s.hub.remove(client, reason)
+	})
+	return found
+}
+
+// Subscribe adds channels to a connected client without reconnecting.
+// Channels the client already has are ignored.
+func (s *SSEServer) Subscribe(clientID string, channels ...string) {
+	s.hub.do(func() {
+		client, ok := s.hub.clients[clientID]
+		if !ok {
+			return
+		}
+		// Build a new slice: the current one may be shared with the ChannelProvider
+		updated := append([]string(nil), client.channels...)
+		for _, ch := range s.config.expandGroups(channels) {
+			if !contains(updated, ch) {
+				updated = append(updated, ch)
+			}
+		}
+		client.channels = updated
+	})
+}
+
+// Unsubscribe removes channels from a connected client without reconnecting.
+func (s *SSEServer) Unsubscribe(clientID string, channels ...string) {
+	s.hub.do(func() {
+		client, ok := s.hub.clients[clientID]
+		if !ok {
+			return
+		}
+		removed := s.config.expandGroups(channels)
+		updated := make([]string, 0, len(client.channels))
+		for _, ch := range client.channels {
+			if !contains(removed, ch) && !contains(updated, ch) {
+				updated = append(updated, ch)
+			}
+		}
+		client.channels = updated
+	})
+}
+
+// authorizedChannels filters channels through ServerConfig.AuthorizeChannel.
+func (s *SSEServer) authorizedChannels(userID, role string, channels []string) []string {
+	allowed := make([]string, 0, len(channels))
+	for _, ch := range channels {
+		if s.config.AuthorizeChannel(userID, role, ch) {
+			allowed = append(allowed, ch)
+		} else {
+			s.tinySSE.debug("SSE channel not authorized:", ch, "user:", userID)
+		}
+	}
+	return allowed
+}
+
+func contains(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// SetMetadata sets a metadata key on a connected client.
+func (s *SSEServer) SetMetadata(clientID, key, value string) {
+	s.hub.do(func() {
+		client, ok := s.hub.clients[clientID]
+		if !ok {
+			return
+		}
+		if client.metadata == nil {
+			client.metadata = make(map[string]string)
+		}
+		client.metadata[key] = value
+	})
+}
+
+func copyMetadata(m map[string]string) map[string]string {
+	out := make(map[string]string, len(m))
+	for k, v := range m {
+		out[k] = v
+	}
+	return out
+}
+
+// validClientID reports whether a client-suggested ID is usable: 1 to 64
+// letters, digits or any of "-_.:".
+func validClientID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, r := range id {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		case r == '-', r == '_', r == '.', r == ':':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// connectedComment is the first line of every stream:
+// ": connected id=<client ID> time=<unix ms>". Browsers ignore comments;
+// the WASM client reads it with the Fetch transport (SSEClient.ConnectionID).
+func connectedComment(id string, now time.Time) string {
+	return ": connected id=" + id + " time=" + Convert(now.UnixMilli()).String() + "\n\n"
+}
@@ -2,8 +2,102 @@
 
 package sse
 
+import (
+	"time"
+
+	. "github.com/tinywasm/fmt"
+)
+
+// DefaultClientChannelBuffer is used when ServerConfig.ClientChannelBuffer is 0.
+const DefaultClientChannelBuffer = 16
+
+// DefaultMaxUnacked is used when ServerConfig.MaxUnacked is 0.
+const DefaultMaxUnacked = 100
+
+// DefaultMaxPausedMessages is used when ServerConfig.MaxPausedMessages is 0.
+const DefaultMaxPausedMessages = 100
+
+// DefaultLongPollTimeout is used when ServerConfig.LongPollTimeout is 0.
+const DefaultLongPollTimeout = 25 * time.Second
+
+// BackpressurePolicy defines what happens when a client's send buffer is full.
+type BackpressurePolicy int
+
+const (
+	// DropNewest skips the new message for that client (default).
+	DropNewest BackpressurePolicy = iota
+	// DropOldest discards the oldest queued message to make room for the new one.
+	DropOldest
+	// Block waits until the client has room. A stalled client delays
+	// delivery to every other client.
+	Block
+)
+
+// DisconnectReason tells ServerConfig.OnDisconnect why a client left.
+type DisconnectReason int
+
+const (
+	// ReasonClientClosed: the client closed the stream or the network failed.
+	ReasonClientClosed DisconnectReason = iota
+	// ReasonDisconnected: the server called Disconnect.
+	ReasonDisconnected
+	// ReasonShutdown: the server called Shutdown.
+	ReasonShutdown
+	// ReasonReplaced: a newer connection of the same user replaced it
+	// (SingleConnectionPerUser).
+	ReasonReplaced
+	// ReasonSlowClient: its buffer stayed full for SlowClientTimeout, or
+	// a write did not complete within WriteTimeout.
+	ReasonSlowClient
+	// ReasonAuthRevoked: the app revoked access (DisconnectWithReason).
+	ReasonAuthRevoked
+	// ReasonExpired: the connection reached MaxConnectionDuration.
+	ReasonExpired
+	// ReasonIdle: nothing was sent to it for IdleTimeout.
+	ReasonIdle
+)
+
+// String returns the reason as used in logs (e.g., "evicted-slow").
+func (r DisconnectReason) String() string {
+	switch r {
+	case ReasonClientClosed:
+		return "client-closed"
+	case ReasonDisconnected:
+		return "disconnected"
+	case ReasonShutdown:
+		return "server-shutdown"
+	case ReasonReplaced:
+		return "replaced"
+	case ReasonSlowClient:
+		return "evicted-slow"
+	case ReasonAuthRevoked:
+		return "auth-revoked"
+	case ReasonExpired:
+		return "expired"
+	case ReasonIdle:
+		return "idle"
+	}
+	return "unknown"
+}
+
+// Middleware transforms or filters a message for one client before it is
+// sent, e.g. to redact fields by role. msg is a copy: modify it or return
+// a new one. Returning false drops the message for that client only.
+// It runs on the hub goroutine for every targeted client (live sends and
+// replays): keep it fast and don't call SSEServer methods from it.
+type Middleware func(client ClientInfo, msg *SSEMessage) (*SSEMessage, bool)
+
 // ServerConfig holds configuration strictly for the Server HTTP Handler.
 type ServerConfig struct {
+	// Endpoint is the path RegisterRoutes mounts the stream at, e.g.
+	// "/events". Must start with "/". Not needed when mounting the
+	// server yourself.
+	Endpoint string
+
+	// AckEndpoint, if set, is the path RegisterRoutes mounts AckHandler
+	// at (see ClientConfig.AckEndpoint), e.g. "/events/ack".
+	AckEndpoint string
+
 	// ClientChannelBuffer prevents blocking on slow clients.
 	// Recommended: 10-100.
 	ClientChannelBuffer int
@@ -12,8 +106,346 @@ type ServerConfig struct {
 	// Recommended: Depends on message frequency.
 	HistoryReplayBuffer int
 
+	// ChannelRetention overrides HistoryReplayBuffer per channel, e.g.
+	// {"notifications": 500, "cursor": 10}: each listed channel keeps its
+	// own most recent N messages, so a chatty channel can't push a quiet
+	// one out of the replay history. A message published to several
+	// channels counts against the first one listed here; everything else
+	// shares HistoryReplayBuffer. Needs a HistoryStore implementing
+	// HistoryRemover (the default store does).
+	ChannelRetention map[string]int
+
+	// ChannelGroups names sets of channels, e.g. {"sports": {"football",
+	// "tennis"}}. Publishing to a group reaches all its member channels,
+	// and a client subscribing to a group (ChannelProvider, Subscribe) is
+	// subscribed to every member. Groups don't nest. Read by the hub at
+	// publish time: don't modify it after creating the server.
+	ChannelGroups map[string][]string
+
+	// HistoryTTL discards history entries older than this duration,
+	// so low-traffic channels don't replay stale messages.
+	// 0 = entries are only trimmed by HistoryReplayBuffer.
+	HistoryTTL time.Duration
+
+	// MaxReplayMessages caps how many messages a reconnecting client is
+	// replayed. Beyond it the client gets a GapEvent (to do a full refresh)
+	// followed by only the newest MaxReplayMessages. 0 = replay all.
+	MaxReplayMessages int
+
+	// HistoryStore holds the replay history.
+	// If nil, an in-memory store is used.
+	HistoryStore HistoryStore
+
+	// PresenceChannel, if set, receives a JSON message on every connect and
+	// disconnect: {"event":"join"|"leave","userID":"...","clientID":"..."}.
+	// Presence messages are stored in history like any other message.
+	PresenceChannel string
+
+	// SingleConnectionPerUser keeps at most one stream per user: a new
+	// connection closes the user's older ones with a ": replaced" comment.
+	// Requires UserProvider; anonymous connections are not affected.
+	SingleConnectionPerUser bool
+
+	// AllowedOrigins lists origins allowed to connect cross-origin, e.g.
+	// "https://app.example.com", or "*" for any. Other origins get 403 and
+	// OPTIONS preflight requests are answered. Only exactly listed origins
+	// may send credentials (cookies). Empty = no CORS headers.
+	AllowedOrigins []string
+
+	// ResponseHeaders are added to every SSE response, overriding the
+	// defaults (Content-Type, Cache-Control, Connection and
+	// "X-Accel-Buffering: no", which stops nginx from buffering events).
+	// An empty value removes the header.
+	ResponseHeaders map[string]string
+
+	// MaxMessageSize limits the data of each published message, in bytes,
+	// before it is stored or sent. Oversized messages are rejected (methods
+	// returning an error report ErrMessageTooLarge; the others log it)
+	// unless TruncateOversized is set. 0 = unlimited.
+	MaxMessageSize int
+
+	// TruncateOversized cuts data to MaxMessageSize instead of rejecting
+	// the message. It may split a multi-byte character or a JSON document.
+	TruncateOversized bool
+
+	// MaxClients limits concurrent connections. Extra connections get
+	// 503 Service Unavailable with a Retry-After header. 0 = unlimited.
+	MaxClients int
+
+	// PerClientRateLimit caps the messages per second a client may cause
+	// through PublishFrom (bursts up to the same amount). Extra messages
+	// are dropped and counted by Metrics.IncDropped. 0 = unlimited.
+	PerClientRateLimit int
+
+	// MaxUnacked caps the PublishWithAck messages tracked per client
+	// (oldest dropped), and how many disconnected clients they are kept
+	// for. Messages trimmed from the replay history are dropped too.
+	// Default: DefaultMaxUnacked (100).
+	MaxUnacked int
+
+	// MaxPausedMessages caps the messages queued for a paused client (see
+	// SSEServer.Pause). Default: DefaultMaxPausedMessages (100).
+	MaxPausedMessages int
+
+	// BackpressurePolicy controls delivery to clients whose buffer is full.
+	// Default: DropNewest.
+	BackpressurePolicy BackpressurePolicy
+
+	// Compress gzips the event stream for clients that send
+	// "Accept-Encoding: gzip". Browsers inflate it natively for both
+	// EventSource and fetch, so the WASM client needs no extra code.
+	// Each event is flushed, so only the compression ratio is affected.
+	Compress bool
+
+	// SlowClientTimeout evicts a client whose buffer has stayed full for
+	// this long (messages kept being dropped for it). Not applied with
+	// BackpressurePolicy Block. 0 = never evict.
+	SlowClientTimeout time.Duration
+
+	// WriteTimeout bounds each write and flush to a client's connection,
+	// so a handler stuck on a dead socket is released and the client
+	// evicted (ReasonSlowClient). Needs a ResponseWriter supporting
+	// http.ResponseController.SetWriteDeadline. 0 = no timeout.
+	WriteTimeout time.Duration
+
+	// IdleTimeout closes a connection nothing was sent to for this long
+	// (ReasonIdle), reclaiming subscribers of quiet channels. Ignored when
+	// HeartbeatInterval is set, as heartbeats keep every stream busy.
+	// 0 = never.
+	IdleTimeout time.Duration
+
+	// LongPollTimeout is how long a LongPollHandler request waits for a
+	// new message before answering empty. Keep it below proxy timeouts.
+	// 0 = DefaultLongPollTimeout (25s).
+	LongPollTimeout time.Duration
+
+	// ConnectJitter sends each new connection a random "retry:" hint
+	// between 1s and 1s+ConnectJitter, so after a server restart browsers
+	// reconnect spread out instead of all at once. 0 = browser default.
+	ConnectJitter time.Duration
+
+	// MaxConnectionDuration closes connections after this long (plus up
+	// to 10% jitter) with a short retry: hint, so clients reconnect with
+	// Last-Event-ID and load balancers can rebalance. 0 = unlimited.
+	MaxConnectionDuration time.Duration
+
+	// OnDisconnect, if set, is called with the ID of every client that
+	// leaves and the reason. It runs in its own goroutine, so it may call
+	// SSEServer methods.
+	OnDisconnect func(clientID string, reason DisconnectReason)
+
+	// EmitTimestamp writes each message's Timestamp as a "time:" field
+	// (unix ms) so clients can measure delivery latency. Only the Fetch
+	// transport reads it; native EventSource ignores unknown fields.
+	EmitTimestamp bool
+
+	// HeartbeatInterval writes a ": ping" comment on idle connections so
+	// proxies don't close them. Pings are not stored in history.
+	// Recommended: 15-30s. 0 = disabled.
+	HeartbeatInterval time.Duration
+
+	// HeartbeatAsEvent sends heartbeats as a HeartbeatEvent instead of a
+	// comment, so clients can detect dead connections with
+	// ClientConfig.HeartbeatTimeout (EventSource hides comments).
+	HeartbeatAsEvent bool
+
+	// Metrics receives hub counters (broadcasts, drops, reconnections,
+	// active clients). If nil, metrics are discarded.
+	Metrics Metrics
+
+	// Bus shares published messages with other server instances for
+	// horizontal scaling. If nil, messages only reach local clients.
+	Bus BusAdapter
+
 	// ChannelProvider resolves channels for each SSE connection.
 	// If nil, a default provider is used that rejects all connections
 	// with error "channel provider not configured".
 	ChannelProvider ChannelProvider
+
+	// UserProvider associates each connection with a user ID.
+	// If nil, connections are anonymous and SendToUser delivers nothing.
+	UserProvider UserProvider
+
+	// RoleProvider associates each connection with a role.
+	// If nil, connections have no role and SendToRole delivers nothing.
+	RoleProvider RoleProvider
+
+	// MetadataProvider sets the initial metadata of each connection.
+	// If nil, connections start with empty metadata.
+	MetadataProvider MetadataProvider
+
+	// ChannelDelimiter enables topic hierarchies: with ".", a client
+	// subscribed to "room" also receives "room.lobby" and
+	// "room.lobby.chat". Empty (default) = exact channel matching.
+	ChannelDelimiter string
+
+	// GenerateClientID returns the ID of each new connection, e.g. to
+	// correlate it with an app session. Must be unique among connected
+	// clients: a duplicate is rejected. Called only from the hub goroutine,
+	// so it needs no locking of its own. If nil, IDs are random UUIDs.
+	GenerateClientID func() string
+
+	// AcceptClientID lets a client suggest its connection ID with the
+	// "clientId" query param (ClientConfig.ClientID), so app-level
+	// correlation survives reconnects. Invalid IDs (see docs/CONFIG.md) are
+	// ignored, and an ID held by another live connection falls back to a
+	// generated one, unless SingleConnectionPerUser replaces that
+	// connection because it belongs to the same user.
+	AcceptClientID bool
+
+	// IDFormat builds each message ID from its sequence (1, 2, ...), e.g.
+	// to add a node prefix or make IDs opaque. IDParse must reverse it so
+	// replay and Ack can order IDs. If nil, IDs are the decimal sequence.
+	IDFormat func(seq uint64, msg *SSEMessage) string
+	IDParse  func(id string) (uint64, error)
+
+	// Middleware runs in order for each client a message is sent to.
+	// Empty = messages are formatted once and sent as published.
+	Middleware []Middleware
+
+	// AuthorizeChannel is called for each resolved channel with the
+	// connection's user and role. Channels it rejects are dropped; if none
+	// remain the connection gets 403. If nil, all channels are allowed.
+	AuthorizeChannel func(userID, role, channel string) bool
+
+	// AuthorizeDelivery, if set, is asked before each channel message (and
+	// replayed message) reaches a client, so revoked permissions (e.g., a
+	// user removed from a room) apply mid-stream without reconnecting.
+	// Returning false skips that client for that message. It runs on the
+	// hub for every matching client of every message: keep it to a fast,
+	// in-memory lookup, as a slow one delays all deliveries.
+	AuthorizeDelivery func(clientID, channel string) bool
+}
+
+// Validate rejects negative values and fills defaults for zero values.
+// Server calls it, logging any error; call it directly to surface errors.
+// Defaults are applied even when an error is returned.
+func (c *ServerConfig) Validate() error {
+	var err error
+	switch {
+	case c.Endpoint != "" && !HasPrefix(c.Endpoint, "/"):
+		err = Err("Endpoint", "must start with /")
+	case c.AckEndpoint != "" && !HasPrefix(c.AckEndpoint, "/"):
+		err = Err("AckEndpoint", "must start with /")
+	case c.ClientChannelBuffer < 0:
+		err = Err("ClientChannelBuffer", "must not be negative")
+	case c.HistoryReplayBuffer < 0:
+		err = Err("HistoryReplayBuffer", "must not be negative")
+	case c.negativeRetention() != "":
+		err = Err("ChannelRetention", c.negativeRetention(), "must not be negative")
+	case c.MaxReplayMessages < 0:
+		err = Err("MaxReplayMessages", "must not be negative")
+	case c.MaxMessageSize < 0:
+		err = Err("MaxMessageSize", "must not be negative")
+	case c.MaxClients < 0:
+		err = Err("MaxClients", "must not be negative")
+	case c.HistoryTTL < 0:
+		err = Err("HistoryTTL", "must not be negative")
+	case c.HeartbeatInterval < 0:
+		err = Err("HeartbeatInterval", "must not be negative")
+	case c.SlowClientTimeout < 0:
+		err = Err("SlowClientTimeout", "must not be negative")
+	case c.WriteTimeout < 0:
+		err = Err("WriteTimeout", "must not be negative")
+	case c.IdleTimeout < 0:
+		err = Err("IdleTimeout", "must not be negative")
+	case c.LongPollTimeout < 0:
+		err = Err("LongPollTimeout", "must not be negative")
+	case c.ConnectJitter < 0:
+		err = Err("ConnectJitter", "must not be negative")
+	case c.MaxConnectionDuration < 0:
+		err = Err("MaxConnectionDuration", "must not be negative")
+	case c.MaxUnacked < 0:
+		err = Err("MaxUnacked", "must not be negative")
+	case c.MaxPausedMessages < 0:
+		err = Err("MaxPausedMessages", "must not be negative")
+	case (c.IDFormat == nil) != (c.IDParse == nil):
+		err = Err("IDFormat", "and IDParse must be set together")
+	}
+
+	if c.ClientChannelBuffer <= 0 {
+		c.ClientChannelBuffer = DefaultClientChannelBuffer
+	}
+	if c.MaxUnacked <= 0 {
+		c.MaxUnacked = DefaultMaxUnacked
+	}
+	if c.MaxPausedMessages <= 0 {
+		c.MaxPausedMessages = DefaultMaxPausedMessages
+	}
+	if c.LongPollTimeout <= 0 {
+		c.LongPollTimeout = DefaultLongPollTimeout
+	}
+	if c.HistoryReplayBuffer < 0 {
+		c.HistoryReplayBuffer = 0
+	}
+	return err
+}
+
+// negativeRetention returns a ChannelRetention channel with a negative
+// limit, or "".
+func (c *ServerConfig) negativeRetention() string {
+	for channel, n := range c.ChannelRetention {
+		if n < 0 {
+			return channel
+		}
+	}
+	return ""
+}
+
+// historyCapacity is the total number of entries the replay history
+// holds: HistoryReplayBuffer plus every ChannelRetention limit.
+func (c *ServerConfig) historyCapacity() int {
+	total := c.HistoryReplayBuffer
+	for _, n := range c.ChannelRetention {
+		if n > 0 {
+			total += n
+		}
+	}
+	return total
+}
+
+// retentionOf returns the retention bucket of a history entry and its
+// limit: the first targeted channel listed in ChannelRetention, or the
+// shared HistoryReplayBuffer ("").
+func (c *ServerConfig) retentionOf(t Target) (string, int) {
+	for _, channel := range t.Channels {
+		if n, ok := c.ChannelRetention[channel]; ok {
+			return channel, n
+		}
+	}
+	return "", c.HistoryReplayBuffer
+}
+
+// expandGroups replaces ChannelGroups names in channels with their
+// members, without duplicates. channels is returned as is when no group
+// is involved.
+func (c *ServerConfig) expandGroups(channels []string) []string {
+	grouped := false
+	for _, ch := range channels {
+		if _, ok := c.ChannelGroups[ch]; ok {
+			grouped = true
+			break
+		}
+	}
+	if !grouped {
+		return channels
+	}
+
+	expanded := make([]string, 0, len(channels))
+	add := func(ch string) {
+		if !contains(expanded, ch) {
+			expanded = append(expanded, ch)
+		}
+	}
+	for _, ch := range channels {
+		members, ok := c.ChannelGroups[ch]
+		if !ok {
+			add(ch)
+			continue
+		}
+		for _, member := range members {
+			add(member)
+		}
+	}
+	return expanded
 }
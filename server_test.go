@@ -3,9 +3,14 @@
 package sse
 
 import (
+	"compress/gzip"
 	"context"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -22,6 +27,52 @@ func (m *mockChannelProvider) ResolveChannels(r *http.Request) ([]string, error)
 	return m.channels, m.err
 }
 
+// ResolveUser implements UserProvider using the "user" query param
+func (m *mockChannelProvider) ResolveUser(r *http.Request) string {
+	return r.URL.Query().Get("user")
+}
+
+// ResolveRole implements RoleProvider using the "role" query param
+func (m *mockChannelProvider) ResolveRole(r *http.Request) string {
+	return r.URL.Query().Get("role")
+}
+
+// ResolveMetadata implements MetadataProvider using the "device" query param
+func (m *mockChannelProvider) ResolveMetadata(r *http.Request) map[string]string {
+	return map[string]string{"device": r.URL.Query().Get("device")}
+}
+
+// mockMetrics records Metrics calls
+type mockMetrics struct {
+	broadcasts, dropped, reconnects, active int
+	replays, replayed, historyLen           int
+}
+
+func (m *mockMetrics) IncBroadcast()          { m.broadcasts++ }
+func (m *mockMetrics) IncDropped()            { m.dropped++ }
+func (m *mockMetrics) IncReconnect()          { m.reconnects++ }
+func (m *mockMetrics) SetActiveClients(n int) { m.active = n }
+func (m *mockMetrics) ObserveReplay(n int)    { m.replays++; m.replayed += n }
+func (m *mockMetrics) SetHistoryLength(n int) { m.historyLen = n }
+
+// connect serves a request in the background. The returned func stops
+// the handler and returns everything written to the stream.
+func connect(server *SSEServer, target string) func() string {
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, "GET", target, nil)
+	w := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		server.ServeHTTP(w, req)
+		close(done)
+	}()
+	return func() string {
+		cancel()
+		<-done
+		return w.Body.String()
+	}
+}
+
 func TestServerFlow(t *testing.T) {
 	// 1. Setup
 	cfg := &Config{Log: testLog(t)}
@@ -65,10 +116,18 @@ func TestServerFlow(t *testing.T) {
 		t.Log("Message published")
 	}()
 
-	// 5. Read Stream
+	// 5. Read Stream, which starts with the connection comment and its
+	// random UUID client ID
 	buf := make([]byte, 1024)
 	t.Log("Reading stream...")
 	n, err := resp.Body.Read(buf)
+	comment := string(buf[:n])
+	const prefix = ": connected id="
+	if err != nil || len(comment) < len(prefix)+36 || !HasPrefix(comment, prefix) ||
+		comment[len(prefix)+14] != '4' || !HasPrefix(comment[len(prefix)+36:], " time=") {
+		t.Fatalf("expected connection comment, got %q (%v)", buf[:n], err)
+	}
+	n, err = resp.Body.Read(buf)
 	t.Logf("Read returned: n=%d err=%v", n, err)
 	if err != nil {
 		t.Fatalf("failed to read response: %v", err)
@@ -89,6 +148,83 @@ func TestServerFlow(t *testing.T) {
 	}
 }
 
+func TestReplayLongerThanBuffer(t *testing.T) {
+	server := New(&Config{}).Server(&ServerConfig{
+		ClientChannelBuffer: 2,
+		HistoryReplayBuffer: 20,
+		ChannelProvider:     &mockChannelProvider{channels: []string{"all"}},
+	})
+	for i := 0; i < 10; i++ {
+		server.PublishN([]byte("x"), "all")
+	}
+
+	stop := connect(server, "/?lastEventId=1")
+	time.Sleep(20 * time.Millisecond)
+	counted := make(chan int)
+	go func() { counted <- server.ClientCount() }()
+	select {
+	case n := <-counted:
+		if n != 1 {
+			t.Errorf("expected 1 client, got %d", n)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("hub deadlocked replaying more than ClientChannelBuffer")
+	}
+	if out := stop(); !HasPrefix(out, ": connected id=") || !Contains(out, "id: 10\n") {
+		t.Errorf("expected the comment then the full replay, got %q", out)
+	}
+}
+
+// blockedWriter is a stream whose writes wait for release, like a client
+// on a very slow link.
+type blockedWriter struct {
+	*httptest.ResponseRecorder
+	release chan struct{}
+}
+
+func (w *blockedWriter) Write(p []byte) (int, error) {
+	<-w.release
+	return w.ResponseRecorder.Write(p)
+}
+
+func TestReplayDoesNotBlockHub(t *testing.T) {
+	server := New(&Config{}).Server(&ServerConfig{
+		ClientChannelBuffer: 1,
+		HistoryReplayBuffer: 50,
+		ChannelProvider:     &mockChannelProvider{channels: []string{"all"}},
+	})
+	for i := 0; i < 50; i++ {
+		server.PublishN([]byte("x"), "all")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, "GET", "/?lastEventId=1", nil)
+	w := &blockedWriter{ResponseRecorder: httptest.NewRecorder(), release: make(chan struct{})}
+	done := make(chan struct{})
+	go func() {
+		server.ServeHTTP(w, req)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		close(w.release)
+		<-done
+	}()
+	time.Sleep(20 * time.Millisecond) // Registered
+
+	// The replay waits on the stalled handler, not on the hub
+	published := make(chan struct{})
+	go func() {
+		server.PublishN([]byte("other"), "elsewhere")
+		close(published)
+	}()
+	select {
+	case <-published:
+	case <-time.After(time.Second):
+		t.Fatal("publish blocked behind a slow client's replay")
+	}
+}
+
 func TestServerHistoryReplay(t *testing.T) {
 	cfg := &Config{Log: testLog(t)}
 	tSSE := New(cfg)
@@ -175,4 +311,2522 @@ func TestChannelProviderError(t *testing.T) {
 	if w.Code != http.StatusUnauthorized {
 		t.Errorf("expected 401, got %d", w.Code)
 	}
+	if n := server.ClientCount(); n != 0 {
+		t.Errorf("rejected connection must not be registered, got %d clients", n)
+	}
+}
+
+func TestSendToUser(t *testing.T) {
+	provider := &mockChannelProvider{channels: []string{"all"}}
+	server := New(&Config{}).Server(&ServerConfig{
+		ClientChannelBuffer: 10,
+		HistoryReplayBuffer: 10,
+		ChannelProvider:     provider,
+		UserProvider:        provider,
+	})
+
+	tab1 := connect(server, "/?user=u1")
+	tab2 := connect(server, "/?user=u1")
+	other := connect(server, "/?user=u2")
+	time.Sleep(50 * time.Millisecond)
+
+	server.SendToUser("u1", []byte("private"))
+	server.SendToUser("nobody", []byte("lost"))
+	time.Sleep(50 * time.Millisecond)
+
+	for i, out := range []string{tab1(), tab2()} {
+		if !Contains(out, "data: private") {
+			t.Errorf("connection %d of u1 missing message, got %q", i, out)
+		}
+	}
+	if out := other(); Contains(out, "data: private") {
+		t.Errorf("u2 should not receive u1 message, got %q", out)
+	}
+}
+
+func TestSendToClient(t *testing.T) {
+	server := NewTestServer(&ServerConfig{
+		ClientChannelBuffer: 10,
+		ChannelProvider:     &mockChannelProvider{channels: []string{"all"}},
+	})
+
+	first := connect(server, "/")
+	time.Sleep(20 * time.Millisecond)
+	second := connect(server, "/")
+	time.Sleep(20 * time.Millisecond)
+
+	// IDs are assigned sequentially per server
+	if err := server.SendToClient("1", []byte("reply")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := server.SendToClient("99", []byte("reply")); err != ErrClientNotFound {
+		t.Errorf("expected ErrClientNotFound, got %v", err)
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	if out := first(); !Contains(out, "data: reply") {
+		t.Errorf("target client missing message, got %q", out)
+	}
+	if out := second(); Contains(out, "data: reply") {
+		t.Errorf("other client should not receive message, got %q", out)
+	}
+}
+
+func TestSendToRole(t *testing.T) {
+	provider := &mockChannelProvider{channels: []string{"all"}}
+	server := New(&Config{}).Server(&ServerConfig{
+		ClientChannelBuffer: 10,
+		ChannelProvider:     provider,
+		RoleProvider:        provider,
+	})
+
+	admin := connect(server, "/?role=admin")
+	upper := connect(server, "/?role=Admin")
+	time.Sleep(50 * time.Millisecond)
+
+	server.SendToRole("admin", []byte("notice"))
+	time.Sleep(50 * time.Millisecond)
+
+	if out := admin(); !Contains(out, "data: notice") {
+		t.Errorf("admin missing message, got %q", out)
+	}
+	if out := upper(); Contains(out, "data: notice") {
+		t.Errorf("role match must be case-sensitive, got %q", out)
+	}
+}
+
+func TestPublishExcept(t *testing.T) {
+	server := NewTestServer(&ServerConfig{
+		ClientChannelBuffer: 10,
+		ChannelProvider:     &mockChannelProvider{channels: []string{"room"}},
+	})
+
+	sender := connect(server, "/")
+	time.Sleep(20 * time.Millisecond)
+	receiver := connect(server, "/")
+	time.Sleep(20 * time.Millisecond)
+
+	server.PublishExcept([]byte("typing"), []string{"1"}, "room")
+	time.Sleep(20 * time.Millisecond)
+
+	if out := sender(); Contains(out, "data: typing") {
+		t.Errorf("excluded client should not receive message, got %q", out)
+	}
+	if out := receiver(); !Contains(out, "data: typing") {
+		t.Errorf("subscribed client missing message, got %q", out)
+	}
+}
+
+func TestPublishNStats(t *testing.T) {
+	server := New(&Config{}).Server(&ServerConfig{
+		ClientChannelBuffer: 1,
+		ChannelProvider:     &mockChannelProvider{channels: []string{"all"}},
+	})
+
+	// Register a client directly so nothing drains its send buffer
+	client := &clientConnection{id: "slow", channels: []string{"all"}, send: make(chan []byte, 1)}
+	server.hub.register <- registerRequest{client: client}
+
+	first := server.PublishN([]byte("one"), "all")
+	if first.Matched != 1 || first.Delivered != 1 || first.Dropped != 0 {
+		t.Errorf("unexpected stats for first message: %+v", first)
+	}
+
+	second := server.PublishN([]byte("two"), "all")
+	if second.Matched != 1 || second.Delivered != 0 || second.Dropped != 1 {
+		t.Errorf("unexpected stats for second message: %+v", second)
+	}
+
+	none := server.PublishN([]byte("three"), "other")
+	if none != (DeliveryStats{}) {
+		t.Errorf("expected zero stats, got %+v", none)
+	}
+}
+
+func TestBackpressureDropOldest(t *testing.T) {
+	server := New(&Config{}).Server(&ServerConfig{
+		BackpressurePolicy: DropOldest,
+		ChannelProvider:    &mockChannelProvider{channels: []string{"all"}},
+	})
+
+	client := &clientConnection{id: "slow", channels: []string{"all"}, send: make(chan []byte, 1)}
+	server.hub.register <- registerRequest{client: client}
+
+	server.PublishN([]byte("old"), "all")
+	stats := server.PublishN([]byte("new"), "all")
+	if stats.Delivered != 1 || stats.Dropped != 1 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+
+	if msg := string(<-client.send); !Contains(msg, "data: new") {
+		t.Errorf("expected newest message to be kept, got %q", msg)
+	}
+}
+
+func TestPublishPriority(t *testing.T) {
+	server := New(&Config{}).Server(&ServerConfig{})
+	client := &clientConnection{id: "slow", channels: []string{"all"}, send: make(chan []byte, 1), high: make(chan []byte, 1)}
+	server.hub.register <- registerRequest{client: client}
+
+	// The normal lane is full: the high-priority message is not stuck behind it
+	server.PublishN([]byte("backlog"), "all")
+	server.PublishN([]byte("dropped"), "all")
+	server.PublishPriority(PriorityHigh, []byte("reload"), "all")
+	server.ClientCount()
+
+	if msg := string(<-client.high); !Contains(msg, "data: reload") {
+		t.Errorf("expected reload on the high lane, got %q", msg)
+	}
+	if msg := string(<-client.send); !Contains(msg, "data: backlog") {
+		t.Errorf("expected backlog on the normal lane, got %q", msg)
+	}
+
+	// Without a high lane, high priority falls back to the normal one
+	plain := &clientConnection{send: make(chan []byte)}
+	if plain.lane(PriorityHigh) != plain.send {
+		t.Error("expected fallback to the normal lane")
+	}
+}
+
+func TestHistoryReplayFiltersChannels(t *testing.T) {
+	server := New(&Config{}).Server(&ServerConfig{
+		ClientChannelBuffer: 10,
+		HistoryReplayBuffer: 10,
+		ChannelProvider:     &mockChannelProvider{channels: []string{"chat"}},
+	})
+
+	server.PublishN([]byte("start"), "chat")
+	server.PublishN([]byte("cpu"), "metrics")
+	server.PublishN([]byte("hello"), "chat")
+
+	client := &clientConnection{id: "c", channels: []string{"chat"}}
+	msgs, gap := server.hub.messagesSince(client, "1")
+
+	if gap {
+		t.Error("unexpected gap")
+	}
+	if len(msgs) != 1 || string(msgs[0].Data) != "hello" {
+		t.Fatalf("expected only the chat message, got %d messages", len(msgs))
+	}
+}
+
+func TestHistoryTTL(t *testing.T) {
+	server := New(&Config{}).Server(&ServerConfig{
+		HistoryReplayBuffer: 10,
+		HistoryTTL:          30 * time.Millisecond,
+		ChannelProvider:     &mockChannelProvider{channels: []string{"all"}},
+	})
+
+	server.PublishN([]byte("first"), "all")
+	server.PublishN([]byte("stale"), "all")
+	time.Sleep(50 * time.Millisecond)
+
+	// Expired entries are skipped even before they are trimmed
+	client := &clientConnection{id: "c", channels: []string{"all"}}
+	msgs, gap := server.hub.messagesSince(client, "1")
+	if len(msgs) != 0 {
+		t.Errorf("expected no replay of stale messages, got %d", len(msgs))
+	}
+	if !gap {
+		t.Error("expected expired messages to be reported as a gap")
+	}
+
+	server.PublishN([]byte("fresh"), "all")
+
+	if n := len(server.hub.history.Since("")); n != 1 {
+		t.Errorf("expected expired entries to be trimmed, got %d", n)
+	}
+}
+
+func TestReplayGapAfterTrim(t *testing.T) {
+	server := New(&Config{}).Server(&ServerConfig{
+		ClientChannelBuffer: 10,
+		HistoryReplayBuffer: 2,
+	})
+	for _, data := range []string{"1", "2", "3", "4"} {
+		server.PublishN([]byte(data), "all")
+	}
+
+	// ID 1 was trimmed: the gap event comes first, then what is left in order
+	client := &clientConnection{id: "c", channels: []string{"all"}, send: make(chan []byte, 10)}
+	frames := server.hub.replayHistory(client, "1")
+	want := []string{"event: reconnect-gap\ndata: 1\n\n", "id: 3\n", "id: 4\n"}
+	if len(frames) != len(want) {
+		t.Fatalf("expected %d frames, got %q", len(want), frames)
+	}
+	for i, w := range want {
+		if !Contains(string(frames[i]), w) {
+			t.Errorf("expected %q, got %q", w, frames[i])
+		}
+	}
+
+	// Up to date: no gap and nothing to replay
+	if msgs, gap := server.hub.messagesSince(client, "4"); gap || len(msgs) != 0 {
+		t.Errorf("expected no gap for the latest ID, got gap=%v msgs=%d", gap, len(msgs))
+	}
+	// Still in history: no gap
+	if msgs, gap := server.hub.messagesSince(client, "3"); gap || len(msgs) != 1 {
+		t.Errorf("expected 1 message and no gap, got gap=%v msgs=%d", gap, len(msgs))
+	}
+}
+
+func TestChannelRetention(t *testing.T) {
+	server := New(&Config{}).Server(&ServerConfig{
+		HistoryReplayBuffer: 2,
+		ChannelRetention:    map[string]int{"notifications": 3},
+	})
+	server.PublishN([]byte("n1"), "notifications")
+	for _, data := range []string{"c1", "c2", "c3", "c4", "c5"} {
+		server.PublishN([]byte(data), "chat")
+	}
+	server.PublishN([]byte("n2"), "notifications")
+
+	// The chatty channel keeps 2, without pushing out the notifications
+	var got []string
+	for _, entry := range server.hub.history.Since("") {
+		got = append(got, string(entry.Message.Data))
+	}
+	if want := "n1,c4,c5,n2"; Convert(got).Join(",").String() != want {
+		t.Errorf("expected history %s, got %v", want, got)
+	}
+
+	server.PublishN([]byte("n3"), "notifications")
+	server.PublishN([]byte("n4"), "notifications")
+	if first := server.hub.history.Since("")[0]; string(first.Message.Data) != "c4" {
+		t.Errorf("expected n1 to be trimmed once notifications exceed 3, got %s", first.Message.Data)
+	}
+
+	cfg := &ServerConfig{ChannelRetention: map[string]int{"x": -1}}
+	if err := cfg.Validate(); err == nil {
+		t.Error("expected an error for a negative ChannelRetention")
+	}
+}
+
+func TestReplayAfterRemove(t *testing.T) {
+	server := New(&Config{}).Server(&ServerConfig{
+		HistoryReplayBuffer: 10,
+		ChannelRetention:    map[string]int{"cursor": 1},
+	})
+	for _, data := range []string{"1", "2", "3", "4", "5"} {
+		server.PublishN([]byte(data), "feed")
+	}
+	server.hub.do(func() { server.hub.history.(HistoryRemover).Remove("3") })
+
+	replay := func(channel, lastEventID string) (frames []string) {
+		client := &clientConnection{id: channel, channels: []string{channel}}
+		server.hub.do(func() {
+			for _, data := range server.hub.replayHistory(client, lastEventID) {
+				frames = append(frames, string(data))
+			}
+		})
+		return frames
+	}
+
+	// A removed Last-Event-ID is not a gap: replay what follows it
+	if got := replay("feed", "3"); len(got) != 2 || !HasPrefix(got[0], "id: 4\n") {
+		t.Errorf("expected 4 and 5 without a gap, got %q", got)
+	}
+
+	// An entry trimmed after Last-Event-ID is
+	server.PublishN([]byte("a"), "cursor")
+	server.PublishN([]byte("b"), "cursor")
+	if got := replay("cursor", "5"); len(got) != 2 || got[0] != formatGapEvent("5") {
+		t.Errorf("expected a gap then b, got %q", got)
+	}
+	if got := replay("cursor", "6"); len(got) != 1 || !Contains(got[0], "data: b\n") {
+		t.Errorf("expected b without a gap, got %q", got)
+	}
+}
+
+// countingStore wraps the memory store to observe hub calls
+type countingStore struct {
+	*memoryHistory
+	appends int
+}
+
+func (c *countingStore) Append(entry HistoryEntry) {
+	c.appends++
+	c.memoryHistory.Append(entry)
+}
+
+func TestCustomHistoryStore(t *testing.T) {
+	store := &countingStore{memoryHistory: newMemoryHistory(0)}
+	server := New(&Config{}).Server(&ServerConfig{
+		HistoryReplayBuffer: 2,
+		HistoryStore:        store,
+		ChannelProvider:     &mockChannelProvider{channels: []string{"all"}},
+	})
+
+	server.PublishN([]byte("msg1"), "all")
+	server.PublishN([]byte("msg2"), "all")
+	server.PublishN([]byte("msg3"), "all")
+
+	if store.appends != 3 {
+		t.Errorf("expected 3 appends, got %d", store.appends)
+	}
+	entries := store.Since("")
+	if len(entries) != 2 || string(entries[0].Message.Data) != "msg2" {
+		t.Errorf("expected store trimmed to the 2 newest entries, got %d", len(entries))
+	}
+	if entries[0].Target.Channels[0] != "all" {
+		t.Errorf("expected target to be stored with the entry")
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	server := New(&Config{}).Server(&ServerConfig{
+		ClientChannelBuffer: 10,
+		ChannelProvider:     &mockChannelProvider{channels: []string{"all"}},
+	})
+
+	stop := connect(server, "/")
+	time.Sleep(20 * time.Millisecond)
+	server.Publish([]byte("last"), "all")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	out := stop()
+	if !Contains(out, "data: last") {
+		t.Errorf("in-flight message not flushed, got %q", out)
+	}
+	if !Contains(out, ": close") {
+		t.Errorf("missing close comment, got %q", out)
+	}
+
+	if stats := server.PublishN([]byte("late"), "all"); stats != (DeliveryStats{}) {
+		t.Errorf("expected no delivery after shutdown, got %+v", stats)
+	}
+}
+
+func TestClientsListing(t *testing.T) {
+	provider := &mockChannelProvider{channels: []string{"all"}}
+	server := New(&Config{}).Server(&ServerConfig{
+		ChannelProvider: provider,
+		UserProvider:    provider,
+		RoleProvider:    provider,
+	})
+
+	stop := connect(server, "/?user=u1&role=admin")
+	time.Sleep(20 * time.Millisecond)
+
+	if n := server.ClientCount(); n != 1 {
+		t.Fatalf("expected 1 client, got %d", n)
+	}
+	list := server.Clients()
+	if len(list) != 1 || list[0].UserID != "u1" || list[0].Role != "admin" || list[0].Channels[0] != "all" {
+		t.Fatalf("unexpected client info: %+v", list)
+	}
+
+	// Mutating the snapshot must not affect the live client
+	list[0].Channels[0] = "changed"
+	if server.Clients()[0].Channels[0] != "all" {
+		t.Error("Clients() must return a copy of channels")
+	}
+
+	stop()
+	if n := server.ClientCount(); n != 0 {
+		t.Errorf("expected 0 clients after disconnect, got %d", n)
+	}
+}
+
+func TestDisconnect(t *testing.T) {
+	server := NewTestServer(&ServerConfig{
+		ClientChannelBuffer: 10,
+		ChannelProvider:     &mockChannelProvider{channels: []string{"all"}},
+	})
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	w := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		server.ServeHTTP(w, req)
+		close(done)
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	if !server.Disconnect("1") {
+		t.Fatal("expected client to exist")
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("handler did not return after Disconnect")
+	}
+
+	if server.Disconnect("1") {
+		t.Error("expected false for an already disconnected client")
+	}
+	if n := server.ClientCount(); n != 0 {
+		t.Errorf("expected 0 clients, got %d", n)
+	}
+}
+
+func TestConcurrentPublishAndDisconnect(t *testing.T) {
+	// Sends and closes both run on the hub goroutine, so a client removed
+	// mid-broadcast is skipped instead of panicking on a closed channel.
+	server := New(&Config{}).Server(&ServerConfig{ClientChannelBuffer: 1})
+
+	for i := 0; i < 200; i++ {
+		client := &clientConnection{
+			id:       server.hub.nextClientID(),
+			channels: []string{"all"},
+			send:     make(chan []byte, 1),
+			done:     make(chan struct{}),
+		}
+		server.hub.register <- registerRequest{client: client}
+
+		var wg sync.WaitGroup
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				server.PublishN([]byte("x"), "all")
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			server.Disconnect(client.id)
+		}()
+		go func() {
+			defer wg.Done()
+			server.hub.unregister <- client
+		}()
+		for range client.send {
+		}
+		wg.Wait()
+	}
+
+	if n := server.ClientCount(); n != 0 {
+		t.Errorf("expected 0 clients, got %d", n)
+	}
+}
+
+func TestSubscribeUnsubscribe(t *testing.T) {
+	server := NewTestServer(&ServerConfig{
+		ClientChannelBuffer: 10,
+		ChannelProvider:     &mockChannelProvider{channels: []string{"all"}},
+	})
+
+	stop := connect(server, "/")
+	time.Sleep(20 * time.Millisecond)
+
+	server.Subscribe("1", "room:1", "room:1", "all")
+	if ch := server.Clients()[0].Channels; len(ch) != 2 || ch[1] != "room:1" {
+		t.Fatalf("expected deduped channels [all room:1], got %v", ch)
+	}
+	server.PublishN([]byte("joined"), "room:1")
+
+	server.Unsubscribe("1", "room:1")
+	server.PublishN([]byte("left"), "room:1")
+
+	out := stop()
+	if !Contains(out, "data: joined") {
+		t.Errorf("missing message after Subscribe, got %q", out)
+	}
+	if Contains(out, "data: left") {
+		t.Errorf("received message after Unsubscribe, got %q", out)
+	}
+}
+
+func TestHeartbeat(t *testing.T) {
+	server := New(&Config{}).Server(&ServerConfig{
+		HistoryReplayBuffer: 10,
+		HeartbeatInterval:   10 * time.Millisecond,
+		ChannelProvider:     &mockChannelProvider{channels: []string{"all"}},
+	})
+
+	stop := connect(server, "/")
+	time.Sleep(50 * time.Millisecond)
+
+	if out := stop(); !Contains(out, ": ping") {
+		t.Errorf("expected heartbeat comment, got %q", out)
+	}
+	if n := len(server.hub.history.Since("")); n != 0 {
+		t.Errorf("heartbeats must not be stored in history, got %d entries", n)
+	}
+}
+
+func TestHeartbeatAsEvent(t *testing.T) {
+	server := New(&Config{}).Server(&ServerConfig{
+		HeartbeatInterval: 10 * time.Millisecond,
+		HeartbeatAsEvent:  true,
+		ChannelProvider:   &mockChannelProvider{channels: []string{"all"}},
+	})
+
+	stop := connect(server, "/")
+	time.Sleep(50 * time.Millisecond)
+
+	if out := stop(); !Contains(out, "event: heartbeat\ndata\n\n") || Contains(out, ": ping") {
+		t.Errorf("expected heartbeat events, got %q", out)
+	}
+}
+
+func TestFormatSSEMessageEvent(t *testing.T) {
+	named := formatSSEMessage(&SSEMessage{ID: "7", Event: "update", Data: []byte("x")})
+	if named != "id: 7\nevent: update\ndata: x\n\n" {
+		t.Errorf("unexpected named event format: %q", named)
+	}
+
+	// Without an event name the browser dispatches to onmessage
+	plain := formatSSEMessage(&SSEMessage{ID: "8", Data: []byte("x")})
+	if Contains(plain, "event:") {
+		t.Errorf("event line must be omitted when empty: %q", plain)
+	}
+}
+
+func TestFormatSSEMessageMultiline(t *testing.T) {
+	payload := "{\n  \"a\": 1,\r\n\n  \"b\": 2\n}"
+	out := formatSSEMessage(&SSEMessage{ID: "3", Data: []byte(payload)})
+
+	want := "id: 3\ndata: {\ndata:   \"a\": 1,\ndata: \ndata:   \"b\": 2\ndata: }\n\n"
+	if out != want {
+		t.Errorf("unexpected multi-line format:\n%q\nwant:\n%q", out, want)
+	}
+}
+
+func TestHandlerIDAsEvent(t *testing.T) {
+	// crudp routes by handlerID through the event name (see DESIGN.md)
+	handlerID := uint8(3)
+	out := formatSSEMessage(&SSEMessage{ID: "1", Event: Convert(handlerID).String(), Data: []byte("x")})
+	if !Contains(out, "event: 3\n") {
+		t.Errorf("expected handlerID as event name, got %q", out)
+	}
+}
+
+func TestFormatSSEMessageRetry(t *testing.T) {
+	out := formatSSEMessage(&SSEMessage{ID: "1", Data: []byte("x"), Retry: 5000})
+	if !Contains(out, "retry: 5000\n") {
+		t.Errorf("missing retry field: %q", out)
+	}
+	if out := formatSSEMessage(&SSEMessage{ID: "2", Data: []byte("x")}); Contains(out, "retry:") {
+		t.Errorf("retry must be omitted when zero: %q", out)
+	}
+}
+
+func TestPublishJSON(t *testing.T) {
+	server := New(&Config{}).Server(&ServerConfig{
+		HistoryReplayBuffer: 10,
+		ChannelProvider:     &mockChannelProvider{channels: []string{"all"}},
+	})
+
+	if err := server.PublishJSON(map[string]int{"count": 1}, "all"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := server.PublishJSON(nil, "all"); err != nil {
+		t.Fatalf("unexpected error for nil: %v", err)
+	}
+	if err := server.PublishJSON(make(chan int), "all"); err == nil {
+		t.Error("expected marshal error")
+	}
+
+	server.ClientCount() // Waits for the hub to finish the last Publish
+	entries := server.hub.history.Since("")
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 published messages, got %d", len(entries))
+	}
+	if string(entries[0].Message.Data) != `{"count":1}` || string(entries[1].Message.Data) != "null" {
+		t.Errorf("unexpected payloads: %s, %s", entries[0].Message.Data, entries[1].Message.Data)
+	}
+}
+
+func TestPublishContextCancelled(t *testing.T) {
+	server := New(&Config{}).Server(&ServerConfig{
+		BackpressurePolicy: Block,
+		ChannelProvider:    &mockChannelProvider{channels: []string{"all"}},
+	})
+
+	// A full client under the Block policy would stall the hub forever
+	client := &clientConnection{id: "stuck", channels: []string{"all"}, send: make(chan []byte, 1)}
+	server.hub.register <- registerRequest{client: client}
+	server.PublishN([]byte("fill"), "all")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := server.PublishContext(ctx, []byte("blocked"), "all"); err != context.DeadlineExceeded {
+		t.Errorf("expected deadline exceeded, got %v", err)
+	}
+
+	if err := server.PublishContext(context.Background(), []byte("ok"), "none"); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestMaxClients(t *testing.T) {
+	server := New(&Config{}).Server(&ServerConfig{
+		MaxClients:      1,
+		ChannelProvider: &mockChannelProvider{channels: []string{"all"}},
+	})
+
+	stop := connect(server, "/")
+	defer stop()
+	time.Sleep(20 * time.Millisecond)
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, req)
+
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503, got %d", w.Code)
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Error("missing Retry-After header")
+	}
+}
+
+func TestClientMetadata(t *testing.T) {
+	provider := &mockChannelProvider{channels: []string{"all"}}
+	server := NewTestServer(&ServerConfig{
+		ChannelProvider:  provider,
+		MetadataProvider: provider,
+	})
+
+	stop := connect(server, "/?device=mobile")
+	defer stop()
+	time.Sleep(20 * time.Millisecond)
+
+	server.SetMetadata("1", "version", "2.1")
+	meta := server.Clients()[0].Metadata
+	if meta["device"] != "mobile" || meta["version"] != "2.1" {
+		t.Errorf("unexpected metadata: %v", meta)
+	}
+}
+
+func TestPresenceChannel(t *testing.T) {
+	provider := &mockChannelProvider{channels: []string{"lobby"}}
+	server := NewTestServer(&ServerConfig{
+		ClientChannelBuffer: 10,
+		HistoryReplayBuffer: 10,
+		PresenceChannel:     "lobby",
+		ChannelProvider:     provider,
+		UserProvider:        provider,
+	})
+
+	watcher := connect(server, "/?user=w")
+	time.Sleep(20 * time.Millisecond)
+	guest := connect(server, "/?user=u2")
+	time.Sleep(20 * time.Millisecond)
+	guest()
+	time.Sleep(20 * time.Millisecond)
+
+	out := watcher()
+	if !Contains(out, `data: {"event":"join","userID":"u2","clientID":"2"}`) {
+		t.Errorf("missing join message, got %q", out)
+	}
+	if !Contains(out, `data: {"event":"leave","userID":"u2","clientID":"2"}`) {
+		t.Errorf("missing leave message, got %q", out)
+	}
+}
+
+func TestPresenceAfterEviction(t *testing.T) {
+	server := NewTestServer(&ServerConfig{
+		PresenceChannel:   "lobby",
+		SlowClientTimeout: time.Millisecond,
+	})
+	watcher := &clientConnection{id: "w", channels: []string{"lobby"}, send: make(chan []byte, 10), done: make(chan struct{})}
+	slow := &clientConnection{id: "s", channels: []string{"lobby"}, send: make(chan []byte, 1), done: make(chan struct{})}
+	server.hub.register <- registerRequest{client: watcher}
+	server.hub.register <- registerRequest{client: slow} // Its own join fills its buffer
+	server.PublishN([]byte("a"), "lobby")
+	time.Sleep(5 * time.Millisecond)
+	server.PublishN([]byte("b"), "lobby") // Evicts the slow client
+
+	// The leave follows the message whose dispatch evicted the client
+	var last []string
+	for len(watcher.send) > 0 {
+		last = append(last, string(<-watcher.send))
+	}
+	if len(last) != 5 || !Contains(last[3], "data: b\n") || !Contains(last[4], `"event":"leave"`) {
+		t.Errorf("expected b then the leave, got %q", last)
+	}
+}
+
+func TestSingleConnectionPerUser(t *testing.T) {
+	provider := &mockChannelProvider{channels: []string{"all"}}
+	server := NewTestServer(&ServerConfig{
+		ClientChannelBuffer:     10,
+		SingleConnectionPerUser: true,
+		ChannelProvider:         provider,
+		UserProvider:            provider,
+	})
+
+	first := connect(server, "/?user=u1")
+	time.Sleep(20 * time.Millisecond)
+	second := connect(server, "/?user=u1")
+	defer second()
+	time.Sleep(20 * time.Millisecond)
+
+	if out := first(); !Contains(out, ": replaced") {
+		t.Errorf("old connection not replaced, got %q", out)
+	}
+	list := server.Clients()
+	if len(list) != 1 || list[0].ID != "2" {
+		t.Errorf("expected only the new connection, got %+v", list)
+	}
+
+	// A full buffer is discarded, but the handler still gets the comment
+	full := &clientConnection{id: "full", userID: "u2", channels: []string{"all"}, send: make(chan []byte, 1), done: make(chan struct{})}
+	server.hub.register <- registerRequest{client: full}
+	server.Publish([]byte("queued"), "all")
+	server.hub.register <- registerRequest{client: &clientConnection{id: "new", userID: "u2", send: make(chan []byte, 1), done: make(chan struct{})}}
+	server.ClientCount()
+	if _, ok := <-full.send; ok || string(full.farewell) != ": replaced\n\n" {
+		t.Errorf("expected a closed buffer and the replaced comment, got %q", full.farewell)
+	}
+}
+
+func TestAcceptClientID(t *testing.T) {
+	provider := &mockChannelProvider{channels: []string{"all"}}
+	server := NewTestServer(&ServerConfig{
+		AcceptClientID:          true,
+		SingleConnectionPerUser: true,
+		ChannelProvider:         provider,
+		UserProvider:            provider,
+	})
+
+	ids := func() map[string]string {
+		out := make(map[string]string)
+		for _, c := range server.Clients() {
+			out[c.ID] = c.UserID
+		}
+		return out
+	}
+
+	tab := connect(server, "/?clientId=tab-1&user=u1")
+	defer tab()
+	bad := connect(server, "/?clientId=bad%20id")
+	defer bad()
+	time.Sleep(20 * time.Millisecond)
+	if got := ids(); got["tab-1"] != "u1" || len(got) != 2 {
+		t.Fatalf("expected tab-1 plus a generated ID, got %v", got)
+	}
+
+	// Another user's collision gets a generated ID
+	other := connect(server, "/?clientId=tab-1&user=u2")
+	defer other()
+	time.Sleep(20 * time.Millisecond)
+	if got := ids(); got["tab-1"] != "u1" || len(got) != 3 {
+		t.Errorf("expected the collision to fall back to a generated ID, got %v", got)
+	}
+
+	// The same user reconnecting takes the ID over
+	again := connect(server, "/?clientId=tab-1&user=u1")
+	defer again()
+	time.Sleep(20 * time.Millisecond)
+	if out := tab(); !Contains(out, ": replaced") {
+		t.Errorf("expected the stale connection to be replaced, got %q", out)
+	}
+	if got := ids(); got["tab-1"] != "u1" || len(got) != 3 {
+		t.Errorf("expected tab-1 to be kept by u1, got %v", got)
+	}
+
+	// Generated IDs skip the ones clients suggested
+	server.hub.register <- registerRequest{client: &clientConnection{id: "9", channels: []string{"all"}, send: make(chan []byte, 1)}, suggestedID: true}
+	server.hub.lastClientID.Store(8)
+	late := connect(server, "/")
+	defer late()
+	time.Sleep(20 * time.Millisecond)
+	if got := ids(); len(got) != 5 {
+		t.Errorf("expected the counter to skip suggested ID 9, got %v", got)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	metrics := &mockMetrics{}
+	server := NewTestServer(&ServerConfig{
+		Metrics:         metrics,
+		ChannelProvider: &mockChannelProvider{channels: []string{"all"}},
+	})
+
+	client := &clientConnection{id: "slow", channels: []string{"all"}, send: make(chan []byte, 1)}
+	server.hub.register <- registerRequest{client: client, lastEventID: "0"}
+	server.PublishN([]byte("one"), "all")
+	server.PublishN([]byte("two"), "all")
+
+	server.hub.do(func() {
+		if metrics.broadcasts != 2 || metrics.dropped != 1 || metrics.reconnects != 1 || metrics.active != 1 {
+			t.Errorf("unexpected metrics: %+v", *metrics)
+		}
+	})
+}
+
+func TestReplayMetrics(t *testing.T) {
+	metrics := &mockMetrics{}
+	server := New(&Config{}).Server(&ServerConfig{
+		ClientChannelBuffer: 10,
+		HistoryReplayBuffer: 2,
+		Metrics:             metrics,
+	})
+	for _, data := range []string{"1", "2", "3"} {
+		server.PublishN([]byte(data), "all")
+	}
+
+	fresh := &clientConnection{id: "fresh", channels: []string{"all"}, send: make(chan []byte, 10)}
+	resumed := &clientConnection{id: "resumed", channels: []string{"all"}, send: make(chan []byte, 10)}
+	server.hub.register <- registerRequest{client: fresh}
+	server.hub.register <- registerRequest{client: resumed, lastEventID: "2"}
+
+	server.hub.do(func() {
+		if metrics.replays != 1 || metrics.replayed != 1 || metrics.historyLen != 2 {
+			t.Errorf("unexpected replay metrics: %+v", *metrics)
+		}
+	})
+}
+
+func TestRequestedChannels(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/events?channel=chat&channel=room%3Aa%20b", nil)
+	got := RequestedChannels(req)
+	if len(got) != 2 || got[0] != "chat" || got[1] != "room:a b" {
+		t.Errorf("unexpected channels: %v", got)
+	}
+}
+
+func TestAuthorizeChannel(t *testing.T) {
+	server := New(&Config{}).Server(&ServerConfig{
+		ChannelProvider: &mockChannelProvider{channels: []string{"all", "admin"}},
+		RoleProvider:    &mockChannelProvider{},
+		AuthorizeChannel: func(userID, role, channel string) bool {
+			return channel != "admin" || role == "admin"
+		},
+	})
+
+	stop := connect(server, "/events?role=user")
+	time.Sleep(20 * time.Millisecond)
+	clients := server.Clients()
+	if len(clients) != 1 || len(clients[0].Channels) != 1 || clients[0].Channels[0] != "all" {
+		t.Errorf("expected only channel all, got %+v", clients)
+	}
+	stop()
+
+	denyAll := New(&Config{}).Server(&ServerConfig{
+		ChannelProvider:  &mockChannelProvider{channels: []string{"admin"}},
+		AuthorizeChannel: func(userID, role, channel string) bool { return false },
+	})
+	req, _ := http.NewRequest("GET", "/", nil)
+	w := httptest.NewRecorder()
+	denyAll.ServeHTTP(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expected 403, got %d", w.Code)
+	}
+}
+
+func TestAuthorizeDelivery(t *testing.T) {
+	removed := map[string]bool{}
+	server := New(&Config{}).Server(&ServerConfig{
+		ClientChannelBuffer: 10,
+		HistoryReplayBuffer: 10,
+		AuthorizeDelivery: func(clientID, channel string) bool {
+			return !removed[clientID+"/"+channel]
+		},
+	})
+	alice := &clientConnection{id: "alice", channels: []string{"room"}, send: make(chan []byte, 10)}
+	bob := &clientConnection{id: "bob", channels: []string{"room"}, send: make(chan []byte, 10)}
+	server.hub.register <- registerRequest{client: alice}
+	server.hub.register <- registerRequest{client: bob}
+
+	server.hub.do(func() { removed["bob/room"] = true })
+	if stats := server.PublishN([]byte("secret"), "room"); stats.Matched != 1 || stats.Delivered != 1 {
+		t.Errorf("expected only alice to get the message, got %+v", stats)
+	}
+	if len(bob.send) != 0 {
+		t.Error("removed client still received the message")
+	}
+
+	// Direct messages are not channel deliveries
+	if err := server.SendToClient("bob", []byte("kicked")); err != nil || len(bob.send) != 1 {
+		t.Errorf("expected direct message to reach bob, got %v", err)
+	}
+
+	// Replay skips the channel message too
+	if msgs, _ := server.hub.messagesSince(bob, "0"); len(msgs) != 1 || string(msgs[0].Data) != "kicked" {
+		t.Errorf("expected only the direct message replayed, got %d", len(msgs))
+	}
+}
+
+func TestBearerToken(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/events?token=query", nil)
+	if got := BearerToken(req); got != "query" {
+		t.Errorf("expected query token, got %q", got)
+	}
+	req.Header.Set("Authorization", "Bearer header")
+	if got := BearerToken(req); got != "header" {
+		t.Errorf("expected header token to win, got %q", got)
+	}
+}
+
+func TestAllowedOrigins(t *testing.T) {
+	server := New(&Config{}).Server(&ServerConfig{
+		AllowedOrigins:  []string{"https://app.example.com"},
+		ChannelProvider: &mockChannelProvider{channels: []string{"all"}},
+	})
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.Header.Set("Origin", "https://evil.example.com")
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expected 403 for disallowed origin, got %d", w.Code)
+	}
+
+	req, _ = http.NewRequest("OPTIONS", "/", nil)
+	req.Header.Set("Origin", "https://app.example.com")
+	req.Header.Set("Access-Control-Request-Headers", "last-event-id")
+	w = httptest.NewRecorder()
+	server.ServeHTTP(w, req)
+	if w.Code != http.StatusNoContent {
+		t.Errorf("expected 204 for preflight, got %d", w.Code)
+	}
+	if w.Header().Get("Access-Control-Allow-Origin") != "https://app.example.com" {
+		t.Errorf("unexpected allow origin: %q", w.Header().Get("Access-Control-Allow-Origin"))
+	}
+	if w.Header().Get("Access-Control-Allow-Headers") != "last-event-id" {
+		t.Errorf("unexpected allow headers: %q", w.Header().Get("Access-Control-Allow-Headers"))
+	}
+
+	wildcard := New(&Config{}).Server(&ServerConfig{AllowedOrigins: []string{"*"}})
+	if allowed, _ := wildcard.matchOrigin("https://any.example.com"); !allowed {
+		t.Error("wildcard should allow any origin")
+	}
+
+	// "*" must not let another site read a cookie-authenticated stream
+	req, _ = http.NewRequest("OPTIONS", "/", nil)
+	req.Header.Set("Origin", "https://evil.example.com")
+	w = httptest.NewRecorder()
+	wildcard.ServeHTTP(w, req)
+	if got := w.Header().Get("Access-Control-Allow-Origin"); got != "*" {
+		t.Errorf("expected literal *, got %q", got)
+	}
+	if w.Header().Get("Access-Control-Allow-Credentials") != "" {
+		t.Error("credentials must not be allowed for a wildcard match")
+	}
+}
+
+func TestServerConfigValidate(t *testing.T) {
+	cfg := &ServerConfig{}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.ClientChannelBuffer != DefaultClientChannelBuffer {
+		t.Errorf("expected default buffer %d, got %d", DefaultClientChannelBuffer, cfg.ClientChannelBuffer)
+	}
+
+	cfg = &ServerConfig{ClientChannelBuffer: -1}
+	if err := cfg.Validate(); err == nil {
+		t.Error("expected error for negative ClientChannelBuffer")
+	}
+	if cfg.ClientChannelBuffer != DefaultClientChannelBuffer {
+		t.Error("default not applied after error")
+	}
+}
+
+func TestRegisterRoutes(t *testing.T) {
+	server := New(&Config{}).Server(&ServerConfig{
+		Endpoint:        "/events",
+		AckEndpoint:     "/events/ack",
+		ChannelProvider: &mockChannelProvider{channels: []string{"all"}},
+	})
+	mux := http.NewServeMux()
+	if err := server.RegisterRoutes(mux); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	req, _ := http.NewRequest("POST", "/events/ack?client=1&id=1", nil)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	if w.Code != http.StatusNoContent {
+		t.Errorf("expected ack endpoint to be mounted, got %d", w.Code)
+	}
+	if _, pattern := mux.Handler(httptest.NewRequest("GET", "/events", nil)); pattern != "/events" {
+		t.Errorf("expected stream at /events, got %q", pattern)
+	}
+
+	for _, endpoint := range []string{"", "events"} {
+		bad := New(&Config{}).Server(&ServerConfig{Endpoint: endpoint})
+		if err := bad.RegisterRoutes(http.NewServeMux()); err == nil {
+			t.Errorf("expected error for endpoint %q", endpoint)
+		}
+	}
+}
+
+func TestNewWithOptions(t *testing.T) {
+	provider := &mockChannelProvider{channels: []string{"all"}}
+	server := NewWithOptions(
+		WithChannelProvider(provider),
+		WithHistoryBuffer(5),
+		WithHeartbeat(time.Second),
+		WithAllowedOrigins("https://app.example.com"),
+	)
+
+	cfg := server.config
+	if cfg.ChannelProvider != provider || cfg.HistoryReplayBuffer != 5 || cfg.HeartbeatInterval != time.Second {
+		t.Errorf("options not applied: %+v", cfg)
+	}
+	if len(cfg.AllowedOrigins) != 1 || cfg.ClientChannelBuffer != DefaultClientChannelBuffer {
+		t.Errorf("unexpected config: %+v", cfg)
+	}
+}
+
+func TestCompress(t *testing.T) {
+	server := New(&Config{}).Server(&ServerConfig{
+		Compress:        true,
+		ChannelProvider: &mockChannelProvider{channels: []string{"all"}},
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, "GET", "/", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		server.ServeHTTP(w, req)
+		close(done)
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	server.Publish([]byte("compressed hello"), "all")
+	server.ClientCount() // barrier: publish dispatched
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+	<-done
+
+	if w.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("expected gzip encoding, got %q", w.Header().Get("Content-Encoding"))
+	}
+	gz, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(gz)
+	if !Contains(string(body), "data: compressed hello") {
+		t.Errorf("unexpected body: %q", body)
+	}
+}
+
+func TestBinaryEncoding(t *testing.T) {
+	server := New(&Config{BinaryEncoding: true}).Server(&ServerConfig{HistoryReplayBuffer: 10})
+	msg := &SSEMessage{ID: "1", Data: []byte{0x00, 0x01, '\n', 0x02, 0xff}}
+
+	out := server.hub.format(msg)
+	if !Contains(out, "data: AAEKAv8=\n") || Contains(out, "\x00") {
+		t.Errorf("expected single base64 data line, got %q", out)
+	}
+	if msg.Data[0] != 0x00 {
+		t.Error("format must not modify the original message")
+	}
+}
+
+func TestGenerateClientID(t *testing.T) {
+	server := New(&Config{}).Server(&ServerConfig{
+		ChannelProvider:  &mockChannelProvider{channels: []string{"all"}},
+		GenerateClientID: func() string { return "session-abc" },
+	})
+
+	stop := connect(server, "/")
+	defer stop()
+	time.Sleep(20 * time.Millisecond)
+
+	clients := server.Clients()
+	if len(clients) != 1 || clients[0].ID != "session-abc" {
+		t.Fatalf("unexpected clients: %+v", clients)
+	}
+
+	// A second connection with the same ID is rejected, not swapped in
+	second := connect(server, "/")
+	time.Sleep(20 * time.Millisecond)
+	second()
+	if clients := server.Clients(); len(clients) != 1 {
+		t.Errorf("expected duplicate to be rejected, got %+v", clients)
+	}
+	if err := server.SendToClient("session-abc", []byte("still here")); err != nil {
+		t.Errorf("original connection lost: %v", err)
+	}
+}
+
+func TestChannelMatches(t *testing.T) {
+	cases := []struct {
+		target, channel string
+		want            bool
+	}{
+		{"user:123", "user:123", true},
+		{"user:*", "user:123", true},
+		{"user:*", "role:admin", false},
+		{"*", "anything", true},
+		{"user:123", "user:*", false}, // Subscriptions are not patterns
+	}
+	for _, c := range cases {
+		if got := channelMatches(c.target, c.channel, ""); got != c.want {
+			t.Errorf("channelMatches(%q, %q) = %v, want %v", c.target, c.channel, got, c.want)
+		}
+	}
+}
+
+func TestChannelMatchesHierarchy(t *testing.T) {
+	for _, sub := range []string{"room", "room.lobby", "room.lobby.chat"} {
+		if !channelMatches("room.lobby.chat", sub, ".") {
+			t.Errorf("subscriber of %q should receive room.lobby.chat", sub)
+		}
+	}
+	if channelMatches("roomy.lobby", "room", ".") {
+		t.Error("prefix without delimiter must not match")
+	}
+	if channelMatches("room", "room.lobby", ".") {
+		t.Error("subtopic subscriber must not receive the parent topic")
+	}
+	if channelMatches("room.lobby", "room", "") {
+		t.Error("empty delimiter must keep exact matching")
+	}
+}
+
+func TestPublishFromRateLimit(t *testing.T) {
+	metrics := &mockMetrics{}
+	server := New(&Config{}).Server(&ServerConfig{
+		ClientChannelBuffer: 10,
+		PerClientRateLimit:  2,
+		Metrics:             metrics,
+	})
+	client := &clientConnection{
+		id:       "sender",
+		channels: []string{"chat"},
+		send:     make(chan []byte, 10),
+		done:     make(chan struct{}),
+	}
+	server.hub.register <- registerRequest{client: client}
+
+	for i := 0; i < 2; i++ {
+		if err := server.PublishFrom("sender", []byte("hi"), "chat"); err != nil {
+			t.Fatalf("message %d: unexpected error %v", i, err)
+		}
+	}
+	if err := server.PublishFrom("sender", []byte("spam"), "chat"); err != ErrRateLimited {
+		t.Errorf("expected ErrRateLimited, got %v", err)
+	}
+	if err := server.PublishFrom("ghost", []byte("hi"), "chat"); err != ErrClientNotFound {
+		t.Errorf("expected ErrClientNotFound, got %v", err)
+	}
+
+	server.ClientCount() // barrier: metrics updated on the hub goroutine
+	if len(client.send) != 2 || metrics.dropped != 1 {
+		t.Errorf("expected 2 delivered and 1 dropped, got %d and %d", len(client.send), metrics.dropped)
+	}
+}
+
+func TestTokenBucketRefill(t *testing.T) {
+	var b tokenBucket
+	now := time.Now()
+	if !b.allow(1, now) || b.allow(1, now) {
+		t.Fatal("expected a burst of exactly 1")
+	}
+	if !b.allow(1, now.Add(time.Second)) {
+		t.Error("expected a token after one second")
+	}
+}
+
+func TestSlowClientEviction(t *testing.T) {
+	reasons := make(chan DisconnectReason, 1)
+	server := New(&Config{}).Server(&ServerConfig{
+		ClientChannelBuffer: 1,
+		SlowClientTimeout:   20 * time.Millisecond,
+		OnDisconnect: func(clientID string, reason DisconnectReason) {
+			reasons <- reason
+		},
+	})
+	client := &clientConnection{
+		id:       "slow",
+		channels: []string{"all"},
+		send:     make(chan []byte, 1),
+		done:     make(chan struct{}),
+	}
+	server.hub.register <- registerRequest{client: client}
+
+	server.PublishN([]byte("fills buffer"), "all")
+	server.PublishN([]byte("dropped"), "all")
+	if n := server.ClientCount(); n != 1 {
+		t.Fatalf("client evicted too early, %d clients", n)
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	server.PublishN([]byte("still full"), "all")
+	if n := server.ClientCount(); n != 0 {
+		t.Errorf("expected slow client to be evicted, got %d clients", n)
+	}
+	select {
+	case reason := <-reasons:
+		if reason != ReasonSlowClient {
+			t.Errorf("expected ReasonSlowClient, got %v", reason)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("OnDisconnect not called")
+	}
+}
+
+func TestOnDisconnectReasons(t *testing.T) {
+	reasons := make(chan DisconnectReason, 2)
+	server := New(&Config{}).Server(&ServerConfig{
+		ChannelProvider: &mockChannelProvider{channels: []string{"all"}},
+		OnDisconnect: func(clientID string, reason DisconnectReason) {
+			reasons <- reason
+		},
+	})
+
+	stop := connect(server, "/")
+	time.Sleep(20 * time.Millisecond)
+	stop()
+	if reason := <-reasons; reason != ReasonClientClosed {
+		t.Errorf("expected ReasonClientClosed, got %v", reason)
+	}
+
+	stop = connect(server, "/")
+	defer stop()
+	time.Sleep(20 * time.Millisecond)
+	server.Disconnect(server.Clients()[0].ID)
+	if reason := <-reasons; reason != ReasonDisconnected {
+		t.Errorf("expected ReasonDisconnected, got %v", reason)
+	}
+
+	stop = connect(server, "/")
+	defer stop()
+	time.Sleep(20 * time.Millisecond)
+	server.DisconnectWithReason(server.Clients()[0].ID, ReasonAuthRevoked)
+	if reason := <-reasons; reason != ReasonAuthRevoked || reason.String() != "auth-revoked" {
+		t.Errorf("expected auth-revoked, got %v", reason)
+	}
+}
+
+func TestPublishAll(t *testing.T) {
+	server := New(&Config{}).Server(&ServerConfig{
+		ClientChannelBuffer: 10,
+		HistoryReplayBuffer: 10,
+	})
+	chat := &clientConnection{id: "a", channels: []string{"chat"}, send: make(chan []byte, 10), done: make(chan struct{})}
+	none := &clientConnection{id: "b", send: make(chan []byte, 10), done: make(chan struct{})}
+	server.hub.register <- registerRequest{client: chat}
+	server.hub.register <- registerRequest{client: none}
+
+	server.PublishN([]byte("first"), "chat")
+	server.PublishAll([]byte("maintenance"))
+	server.ClientCount() // barrier: publish dispatched
+
+	if len(chat.send) != 2 || len(none.send) != 1 {
+		t.Errorf("expected every client to get the notice, got %d and %d", len(chat.send), len(none.send))
+	}
+
+	// Replayed to reconnecting clients regardless of channels
+	msgs, _ := server.hub.messagesSince(&clientConnection{id: "c"}, "1")
+	if len(msgs) != 1 || string(msgs[0].Data) != "maintenance" {
+		t.Errorf("expected notice in replay, got %d messages", len(msgs))
+	}
+}
+
+// levelLogger records the level of every message
+type levelLogger struct {
+	mu     sync.Mutex
+	levels []string
+}
+
+func (l *levelLogger) add(level string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.levels = append(l.levels, level)
+}
+
+func (l *levelLogger) Debug(args ...any) { l.add("debug") }
+func (l *levelLogger) Info(args ...any)  { l.add("info") }
+func (l *levelLogger) Warn(args ...any)  { l.add("warn") }
+func (l *levelLogger) Error(args ...any) { l.add("error") }
+
+func TestLoggerLevels(t *testing.T) {
+	logger := &levelLogger{}
+	var plain int
+	server := New(&Config{Logger: logger, Log: func(args ...any) { plain++ }}).Server(&ServerConfig{
+		ChannelProvider: &mockChannelProvider{err: Err("bad token")},
+	})
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	server.ServeHTTP(httptest.NewRecorder(), req)
+
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	if len(logger.levels) != 1 || logger.levels[0] != "warn" {
+		t.Errorf("expected one warn for the auth failure, got %v", logger.levels)
+	}
+	if plain != 0 {
+		t.Error("Log must not be called when Logger is set")
+	}
+}
+
+func TestPublishWithAck(t *testing.T) {
+	server := New(&Config{}).Server(&ServerConfig{
+		ClientChannelBuffer: 10,
+		HistoryReplayBuffer: 10,
+		GenerateClientID:    func() string { return "tab-1" },
+	})
+	client := &clientConnection{id: "tab-1", channels: []string{"orders"}, send: make(chan []byte, 10), done: make(chan struct{})}
+	server.hub.register <- registerRequest{client: client}
+
+	server.PublishWithAck([]byte("order 1"), "orders")
+	server.PublishWithAck([]byte("order 2"), "orders")
+	server.Publish([]byte("not tracked"), "orders")
+	if n := server.UnackedCount("tab-1"); n != 2 {
+		t.Fatalf("expected 2 unacked, got %d", n)
+	}
+
+	// Ack is cumulative through the HTTP endpoint
+	req, _ := http.NewRequest("POST", "/ack?client=tab-1&id=1", nil)
+	w := httptest.NewRecorder()
+	server.AckHandler().ServeHTTP(w, req)
+	if w.Code != http.StatusNoContent || server.UnackedCount("tab-1") != 1 {
+		t.Fatalf("expected 204 and 1 unacked, got %d and %d", w.Code, server.UnackedCount("tab-1"))
+	}
+
+	// The client drops and comes back with the same ID after seeing ID 3:
+	// order 2 is re-sent even though it is before its Last-Event-ID
+	server.hub.unregister <- client
+	again := &clientConnection{id: "tab-1", channels: []string{"orders"}, send: make(chan []byte, 10), done: make(chan struct{})}
+	server.hub.register <- registerRequest{client: again, lastEventID: "3"}
+	server.ClientCount() // barrier: registered
+
+	if len(again.send) != 1 || !Contains(string(<-again.send), "data: order 2") {
+		t.Error("expected the unacked message to be re-sent on reconnect")
+	}
+}
+
+func TestPublishWithAckAcceptedID(t *testing.T) {
+	server := New(&Config{}).Server(&ServerConfig{
+		ClientChannelBuffer: 10,
+		AcceptClientID:      true,
+	})
+	client := &clientConnection{id: "tab-1", channels: []string{"orders"}, send: make(chan []byte, 10), done: make(chan struct{})}
+	server.hub.register <- registerRequest{client: client, suggestedID: true}
+	server.PublishWithAck([]byte("order 1"), "orders")
+
+	// The client suggests its ID again when it reconnects
+	server.hub.unregister <- client
+	again := &clientConnection{id: "tab-1", channels: []string{"orders"}, send: make(chan []byte, 10), done: make(chan struct{})}
+	server.hub.register <- registerRequest{client: again, suggestedID: true}
+	server.ClientCount() // barrier: registered
+
+	if len(again.send) != 1 || !Contains(string(<-again.send), "data: order 1") {
+		t.Error("expected the unacked message to be re-sent to the accepted ID")
+	}
+}
+
+func TestUnackedBounds(t *testing.T) {
+	server := New(&Config{}).Server(&ServerConfig{
+		ClientChannelBuffer: 10,
+		HistoryReplayBuffer: 2,
+		MaxUnacked:          1,
+		AcceptClientID:      true,
+	})
+	var clients []*clientConnection
+	for _, id := range []string{"a", "b"} {
+		c := &clientConnection{id: id, channels: []string{"orders"}, send: make(chan []byte, 10), done: make(chan struct{})}
+		server.hub.register <- registerRequest{client: c, suggestedID: true}
+		clients = append(clients, c)
+	}
+	server.PublishWithAck([]byte("order"), "orders")
+
+	// Only the most recently departed client keeps its messages
+	for _, c := range clients {
+		server.hub.unregister <- c
+	}
+	if a, b := server.UnackedCount("a"), server.UnackedCount("b"); a != 0 || b != 1 {
+		t.Errorf("expected only b tracked, got a=%d b=%d", a, b)
+	}
+
+	// Trimmed from history: no longer tracked
+	server.PublishN([]byte("1"), "orders")
+	server.PublishN([]byte("2"), "orders")
+	if n := server.UnackedCount("b"); n != 0 {
+		t.Errorf("expected the trimmed message dropped, got %d", n)
+	}
+}
+
+func TestAckHandlerRejects(t *testing.T) {
+	server := New(&Config{}).Server(&ServerConfig{})
+	for _, c := range []struct {
+		method, target string
+		code           int
+	}{
+		{"GET", "/ack?client=a&id=1", http.StatusMethodNotAllowed},
+		{"POST", "/ack?client=a", http.StatusBadRequest},
+	} {
+		req, _ := http.NewRequest(c.method, c.target, nil)
+		w := httptest.NewRecorder()
+		server.AckHandler().ServeHTTP(w, req)
+		if w.Code != c.code {
+			t.Errorf("%s %s: expected %d, got %d", c.method, c.target, c.code, w.Code)
+		}
+	}
+
+	// Cross-origin acks are POSTed: the preflight must allow it
+	server.config.AllowedOrigins = []string{"https://app.example"}
+	req, _ := http.NewRequest("OPTIONS", "/ack", nil)
+	req.Header.Set("Origin", "https://app.example")
+	w := httptest.NewRecorder()
+	server.AckHandler().ServeHTTP(w, req)
+	if got := w.Header().Get("Access-Control-Allow-Methods"); got != "POST, OPTIONS" {
+		t.Errorf("expected POST allowed, got %q", got)
+	}
+}
+
+func TestPauseResume(t *testing.T) {
+	server := New(&Config{}).Server(&ServerConfig{
+		ClientChannelBuffer: 10,
+		MaxPausedMessages:   2,
+	})
+	client := &clientConnection{id: "m", channels: []string{"feed"}, send: make(chan []byte, 10), done: make(chan struct{})}
+	server.hub.register <- registerRequest{client: client}
+
+	if err := server.Pause("m"); err != nil {
+		t.Fatal(err)
+	}
+	server.PublishN([]byte("1"), "feed")
+	server.PublishN([]byte("2"), "feed")
+	if stats := server.PublishN([]byte("3"), "feed"); stats.Dropped != 1 {
+		t.Errorf("expected overflow to be dropped, got %+v", stats)
+	}
+	if len(client.send) != 0 {
+		t.Fatal("paused client must not receive messages")
+	}
+
+	if err := server.Resume("m"); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"data: 1\n", "data: 2\n"} {
+		if got := string(<-client.send); !Contains(got, want) {
+			t.Errorf("expected %q in order, got %q", want, got)
+		}
+	}
+	if err := server.Pause("ghost"); err != ErrClientNotFound {
+		t.Errorf("expected ErrClientNotFound, got %v", err)
+	}
+}
+
+func TestLastEventIDSources(t *testing.T) {
+	server := New(&Config{}).Server(&ServerConfig{
+		HistoryReplayBuffer: 10,
+		ChannelProvider:     &mockChannelProvider{channels: []string{"all"}},
+	})
+	for _, data := range []string{"1", "2", "3"} {
+		server.PublishN([]byte(data), "all")
+	}
+
+	replayed := func(header, query string) string {
+		ctx, cancel := context.WithCancel(context.Background())
+		req, _ := http.NewRequestWithContext(ctx, "GET", "/events"+query, nil)
+		if header != "" {
+			req.Header.Set("Last-Event-ID", header)
+		}
+		w := httptest.NewRecorder()
+		done := make(chan struct{})
+		go func() {
+			server.ServeHTTP(w, req)
+			close(done)
+		}()
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+		<-done
+		return w.Body.String()
+	}
+
+	// Header only (native EventSource reconnect)
+	if body := replayed("2", ""); Contains(body, "id: 2\n") || !Contains(body, "id: 3\n") {
+		t.Errorf("header: unexpected replay %q", body)
+	}
+	// Query param only (manual reconnect, page reload)
+	if body := replayed("", "?lastEventId=2"); Contains(body, "id: 2\n") || !Contains(body, "id: 3\n") {
+		t.Errorf("query: unexpected replay %q", body)
+	}
+	// Both: the header wins
+	if body := replayed("1", "?lastEventId=2"); !Contains(body, "id: 2\n") {
+		t.Errorf("expected header to take precedence, got %q", body)
+	}
+}
+
+func TestMaxConnectionDuration(t *testing.T) {
+	reasons := make(chan DisconnectReason, 1)
+	server := New(&Config{}).Server(&ServerConfig{
+		MaxConnectionDuration: 20 * time.Millisecond,
+		ChannelProvider:       &mockChannelProvider{channels: []string{"all"}},
+		OnDisconnect: func(clientID string, reason DisconnectReason) {
+			reasons <- reason
+		},
+	})
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	w := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		server.ServeHTTP(w, req)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("connection not closed after MaxConnectionDuration")
+	}
+	if !Contains(w.Body.String(), "retry: 1000\n\n") {
+		t.Errorf("expected retry hint, got %q", w.Body.String())
+	}
+	if reason := <-reasons; reason != ReasonExpired {
+		t.Errorf("expected ReasonExpired, got %v", reason)
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	reasons := make(chan DisconnectReason, 1)
+	server := New(&Config{}).Server(&ServerConfig{
+		IdleTimeout:     100 * time.Millisecond,
+		ChannelProvider: &mockChannelProvider{channels: []string{"all"}},
+		OnDisconnect: func(clientID string, reason DisconnectReason) {
+			reasons <- reason
+		},
+	})
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	w := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		server.ServeHTTP(w, req)
+		close(done)
+	}()
+
+	// Messages keep it open past the timeout
+	for i := 0; i < 3; i++ {
+		time.Sleep(60 * time.Millisecond)
+		server.Publish([]byte("tick"), "all")
+	}
+	select {
+	case <-done:
+		t.Fatal("active connection closed as idle")
+	default:
+	}
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("connection not closed after IdleTimeout")
+	}
+	if reason := <-reasons; reason != ReasonIdle {
+		t.Errorf("expected ReasonIdle, got %v", reason)
+	}
+}
+
+func TestDebugSnapshot(t *testing.T) {
+	server := New(&Config{}).Server(&ServerConfig{
+		ClientChannelBuffer: 10,
+		HistoryReplayBuffer: 10,
+	})
+	for _, c := range []*clientConnection{
+		{id: "a", channels: []string{"chat", "all"}},
+		{id: "b", channels: []string{"all"}},
+	} {
+		c.send, c.done = make(chan []byte, 10), make(chan struct{})
+		server.hub.register <- registerRequest{client: c}
+	}
+	server.PublishN([]byte("x"), "all")
+	server.Pause("b")
+
+	snap := server.DebugSnapshot()
+	if snap.Clients != 2 || snap.Paused != 1 || snap.HistoryLen != 1 || snap.LastID != "1" {
+		t.Errorf("unexpected snapshot: %+v", snap)
+	}
+	if snap.Channels["all"] != 2 || snap.Channels["chat"] != 1 {
+		t.Errorf("unexpected channel counts: %v", snap.Channels)
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	server := New(&Config{}).Server(&ServerConfig{
+		ClientChannelBuffer: 10,
+		HistoryReplayBuffer: 10,
+		Middleware: []Middleware{
+			func(client ClientInfo, msg *SSEMessage) (*SSEMessage, bool) {
+				return msg, client.Role != "guest"
+			},
+			func(client ClientInfo, msg *SSEMessage) (*SSEMessage, bool) {
+				if client.Role != "admin" {
+					msg.Data = []byte("redacted")
+				}
+				return msg, true
+			},
+		},
+	})
+	clients := map[string]*clientConnection{}
+	for _, role := range []string{"admin", "user", "guest"} {
+		c := &clientConnection{id: role, role: role, channels: []string{"all"}, send: make(chan []byte, 10), done: make(chan struct{})}
+		clients[role] = c
+		server.hub.register <- registerRequest{client: c}
+	}
+
+	stats := server.PublishN([]byte("secret"), "all")
+	if stats.Delivered != 2 {
+		t.Errorf("expected 2 deliveries, got %+v", stats)
+	}
+	if got := string(<-clients["admin"].send); !Contains(got, "data: secret") {
+		t.Errorf("admin: unexpected %q", got)
+	}
+	if got := string(<-clients["user"].send); !Contains(got, "data: redacted") {
+		t.Errorf("user: unexpected %q", got)
+	}
+	if len(clients["guest"].send) != 0 {
+		t.Error("guest should not receive the message")
+	}
+
+	// History keeps the original and replay goes through middleware too
+	replay := &clientConnection{id: "r", role: "user", channels: []string{"all"}}
+	if frames := server.hub.replayHistory(replay, "0"); len(frames) != 1 || !Contains(string(frames[0]), "data: redacted") {
+		t.Errorf("replay: unexpected %q", frames)
+	}
+}
+
+func TestEmitTimestamp(t *testing.T) {
+	for _, emit := range []bool{true, false} {
+		server := New(&Config{}).Server(&ServerConfig{ClientChannelBuffer: 10, EmitTimestamp: emit})
+		client := &clientConnection{id: "a", channels: []string{"all"}, send: make(chan []byte, 10), done: make(chan struct{})}
+		server.hub.register <- registerRequest{client: client}
+
+		before := time.Now().UnixMilli()
+		server.PublishN([]byte("x"), "all")
+		got := string(<-client.send)
+
+		if Contains(got, "time: ") != emit {
+			t.Errorf("EmitTimestamp=%v: unexpected %q", emit, got)
+		}
+		if emit && !Contains(got, "time: "+Convert(before).String()[:8]) {
+			t.Errorf("expected current unix ms, got %q", got)
+		}
+	}
+}
+
+func TestConnectJitter(t *testing.T) {
+	server := New(&Config{}).Server(&ServerConfig{
+		ConnectJitter:   time.Second,
+		ChannelProvider: &mockChannelProvider{channels: []string{"all"}},
+	})
+
+	stop := connect(server, "/")
+	time.Sleep(20 * time.Millisecond)
+	body := stop()
+
+	// 1000-1999 ms: four digits starting with 1
+	if !HasPrefix(body, "retry: 1") || len(body) < 13 || body[11:13] != "\n\n" {
+		t.Fatalf("expected retry hint between 1000 and 1999 ms, got %q", body)
+	}
+}
+
+func TestHTTP1ConnectionLimitWarning(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/", nil)
+	if IsHTTP2(req) {
+		t.Error("expected HTTP/1.1 request")
+	}
+	req.ProtoMajor = 2
+	if !IsHTTP2(req) {
+		t.Error("expected HTTP/2 request")
+	}
+	req.RemoteAddr = "[::1]:51234"
+	if host := remoteHost(req); host != "[::1]" {
+		t.Errorf("unexpected host %q", host)
+	}
+
+	logger := &levelLogger{}
+	server := New(&Config{Logger: logger}).Server(&ServerConfig{})
+	for i := 0; i < http1ConnLimit; i++ {
+		c := &clientConnection{id: Convert(i).String(), http1Host: "10.0.0.1", send: make(chan []byte, 1), done: make(chan struct{})}
+		server.hub.register <- registerRequest{client: c}
+	}
+	server.ClientCount() // barrier: registered
+
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	warns := 0
+	for _, level := range logger.levels {
+		if level == "warn" {
+			warns++
+		}
+	}
+	if warns != 1 {
+		t.Errorf("expected 1 warning at the limit, got %d (%v)", warns, logger.levels)
+	}
+}
+
+func TestPublishBatched(t *testing.T) {
+	server := New(&Config{}).Server(&ServerConfig{})
+	client := &clientConnection{id: "b", channels: []string{"ticks", "ticks,x"}, send: make(chan []byte, 10), done: make(chan struct{})}
+	server.hub.register <- registerRequest{client: client}
+
+	for _, data := range []string{"1", "2", "3"} {
+		server.PublishBatched([]byte(data), 20*time.Millisecond, "ticks")
+	}
+
+	select {
+	case got := <-client.send:
+		want := "event: batch\ndata: 1\ndata: 2\ndata: 3\n\n"
+		if !Contains(string(got), want) {
+			t.Errorf("expected one batch %q, got %q", want, got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("batch was not flushed")
+	}
+	if len(client.send) != 0 {
+		t.Error("expected a single batched message")
+	}
+
+	// Items with newlines are dropped, and channel names can't collide
+	server.PublishBatched([]byte("x\ny"), 20*time.Millisecond, "ticks")
+	server.PublishBatched([]byte("a"), 20*time.Millisecond, "ticks,x")
+	server.PublishBatched([]byte("b"), 20*time.Millisecond, "ticks", "x")
+	var got []string
+	for len(got) < 2 {
+		select {
+		case frame := <-client.send:
+			got = append(got, string(frame))
+		case <-time.After(time.Second):
+			t.Fatalf("expected 2 batches, got %q", got)
+		}
+	}
+	for _, frame := range got {
+		if Contains(frame, "data: x") || Contains(frame, "data: a\ndata: b") {
+			t.Errorf("unexpected batch %q", frame)
+		}
+	}
+
+	msg := &SSEMessage{Event: BatchEvent, Data: []byte("1\n2\n3")}
+	if items := msg.BatchItems(); len(items) != 3 || string(items[2]) != "3" {
+		t.Errorf("unexpected items %q", items)
+	}
+}
+
+func TestReconnectSameIDNoDuplicates(t *testing.T) {
+	server := New(&Config{}).Server(&ServerConfig{
+		ClientChannelBuffer: 100,
+		HistoryReplayBuffer: 1000,
+	})
+
+	seen := make(map[string]bool)
+	lastID := ""
+	published := 0
+	for round := 0; round < 20; round++ {
+		client := &clientConnection{id: "same", channels: []string{"feed"}, send: make(chan []byte, 100), done: make(chan struct{})}
+		server.hub.register <- registerRequest{client: client, lastEventID: lastID}
+		for i := 0; i < 5; i++ {
+			server.PublishN([]byte("x"), "feed")
+			published++
+		}
+
+		// Read only part of the queue before the connection drops
+		for i := 0; i < 3 && len(client.send) > 0; i++ {
+			id := eventID(string(<-client.send))
+			if seen[id] {
+				t.Fatalf("duplicate message %s in round %d", id, round)
+			}
+			seen[id] = true
+			lastID = id
+		}
+		server.hub.unregister <- client
+		server.ClientCount() // barrier: removed
+		if _, ok := <-client.send; ok {
+			t.Fatal("expected old send channel to be drained and closed")
+		}
+	}
+
+	final := &clientConnection{id: "same", channels: []string{"feed"}, send: make(chan []byte, 1000), done: make(chan struct{})}
+	server.hub.register <- registerRequest{client: final, lastEventID: lastID}
+	server.ClientCount()
+	for len(final.send) > 0 {
+		id := eventID(string(<-final.send))
+		if seen[id] {
+			t.Fatalf("duplicate message %s on replay", id)
+		}
+		seen[id] = true
+	}
+	if len(seen) != published {
+		t.Errorf("expected %d distinct messages, got %d", published, len(seen))
+	}
+}
+
+// eventID returns the id: field of a formatted SSE message.
+func eventID(raw string) string {
+	for _, line := range Convert(raw).Split("\n") {
+		if HasPrefix(line, "id: ") {
+			return line[4:]
+		}
+	}
+	return ""
+}
+
+func TestIDFormat(t *testing.T) {
+	server := New(&Config{}).Server(&ServerConfig{
+		HistoryReplayBuffer: 10,
+		IDFormat: func(seq uint64, msg *SSEMessage) string {
+			return "node1-" + Convert(seq).String()
+		},
+		IDParse: func(id string) (uint64, error) {
+			if !HasPrefix(id, "node1-") {
+				return 0, Err("unknown node")
+			}
+			n, err := Convert(id[len("node1-"):]).Int64()
+			return uint64(n), err
+		},
+	})
+	for _, data := range []string{"1", "2", "3"} {
+		server.PublishN([]byte(data), "feed")
+	}
+	if snap := server.DebugSnapshot(); snap.LastID != "node1-3" {
+		t.Errorf("expected prefixed last ID, got %q", snap.LastID)
+	}
+
+	client := &clientConnection{id: "c", channels: []string{"feed"}, send: make(chan []byte, 10), done: make(chan struct{})}
+	server.hub.register <- registerRequest{client: client, lastEventID: "node1-1"}
+	for _, want := range []string{"id: node1-2\n", "id: node1-3\n"} {
+		if got := string(<-client.send); !Contains(got, want) {
+			t.Errorf("expected %q in order, got %q", want, got)
+		}
+	}
+
+	cfg := &ServerConfig{IDFormat: func(seq uint64, msg *SSEMessage) string { return "" }}
+	if err := cfg.Validate(); err == nil {
+		t.Error("expected error for IDFormat without IDParse")
+	}
+}
+
+// memBus is an in-process BusAdapter shared by several servers.
+type memBus struct {
+	mu   sync.Mutex
+	subs []func(BusMessage)
+}
+
+func (b *memBus) Publish(msg BusMessage) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, fn := range b.subs {
+		go fn(msg)
+	}
+}
+
+func (b *memBus) Subscribe(fn func(BusMessage)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.subs = append(b.subs, fn)
+}
+
+func TestBusAdapter(t *testing.T) {
+	bus := &memBus{}
+	node1 := New(&Config{}).Server(&ServerConfig{Bus: bus})
+	node2 := New(&Config{}).Server(&ServerConfig{Bus: bus, HistoryReplayBuffer: 10})
+
+	local := &clientConnection{id: "a", channels: []string{"news"}, send: make(chan []byte, 10), done: make(chan struct{})}
+	remote := &clientConnection{id: "b", channels: []string{"news"}, send: make(chan []byte, 10), done: make(chan struct{})}
+	node1.hub.register <- registerRequest{client: local}
+	node2.hub.register <- registerRequest{client: remote}
+
+	node1.PublishEvent("update", []byte("hello"), "news")
+
+	for name, c := range map[string]*clientConnection{"local": local, "remote": remote} {
+		select {
+		case got := <-c.send:
+			if !Contains(string(got), "event: update\ndata: hello\n") {
+				t.Errorf("%s client got %q", name, got)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%s client did not receive the message", name)
+		}
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	if len(local.send) != 0 {
+		t.Error("message echoed back to its origin node")
+	}
+	if snap := node2.DebugSnapshot(); snap.HistoryLen != 1 || snap.LastID != "1" {
+		t.Errorf("expected remote message in local history, got %+v", snap)
+	}
+}
+
+func TestHistorySnapshot(t *testing.T) {
+	server := New(&Config{}).Server(&ServerConfig{HistoryReplayBuffer: 10})
+	server.PublishN([]byte("a1"), "a")
+	server.PublishN([]byte("b1"), "b")
+	server.PublishAll([]byte("all"))
+	server.SendToUser("u1", []byte("private"))
+	server.PublishN([]byte("a2"), "a")
+	server.PublishN([]byte("a3"), "a")
+
+	msgs := server.HistorySnapshot([]string{"a"}, 3)
+	var got []string
+	for _, m := range msgs {
+		got = append(got, string(m.Data))
+	}
+	if s := Convert(got).Join(",").String(); s != "all,a2,a3" {
+		t.Errorf("expected the 3 latest for channel a, got %q", s)
+	}
+
+	msgs[0].Data[0] = 'X'
+	if all := server.HistorySnapshot([]string{"a"}, 0); string(all[1].Data) != "all" || len(all) != 4 {
+		t.Errorf("snapshot must be a copy of the full history, got %d messages", len(all))
+	}
+}
+
+// deadlineWriter is a ResponseWriter supporting write deadlines whose
+// writes of "stall" frames time out, like a dead socket.
+type deadlineWriter struct {
+	*httptest.ResponseRecorder
+	deadlines atomic.Int32
+	stall     time.Duration // How long the "stall" write hangs before timing out
+}
+
+func (w *deadlineWriter) SetWriteDeadline(t time.Time) error {
+	w.deadlines.Add(1)
+	return nil
+}
+
+func (w *deadlineWriter) Write(p []byte) (int, error) {
+	if Contains(string(p), "stall") {
+		time.Sleep(w.stall)
+		return 0, os.ErrDeadlineExceeded
+	}
+	return w.ResponseRecorder.Write(p)
+}
+
+func TestWriteTimeout(t *testing.T) {
+	reasons := make(chan DisconnectReason, 1)
+	server := New(&Config{}).Server(&ServerConfig{
+		WriteTimeout:    time.Second,
+		ChannelProvider: &mockChannelProvider{channels: []string{"all"}},
+		OnDisconnect: func(clientID string, reason DisconnectReason) {
+			reasons <- reason
+		},
+	})
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	w := &deadlineWriter{ResponseRecorder: httptest.NewRecorder()}
+	done := make(chan struct{})
+	go func() {
+		server.ServeHTTP(w, req)
+		close(done)
+	}()
+	for server.ClientCount() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	server.Publish([]byte("ok"), "all")
+	server.Publish([]byte("stall"), "all")
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("handler not released after write timeout")
+	}
+	if reason := <-reasons; reason != ReasonSlowClient {
+		t.Errorf("expected ReasonSlowClient, got %v", reason)
+	}
+	if w.deadlines.Load() < 2 {
+		t.Errorf("expected a deadline per write, got %d", w.deadlines.Load())
+	}
+}
+
+func TestWriteTimeoutWithBlockPolicy(t *testing.T) {
+	server := New(&Config{}).Server(&ServerConfig{
+		WriteTimeout:        time.Second,
+		BackpressurePolicy:  Block,
+		ClientChannelBuffer: 1,
+		ChannelProvider:     &mockChannelProvider{channels: []string{"all"}},
+	})
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	w := &deadlineWriter{ResponseRecorder: httptest.NewRecorder(), stall: 50 * time.Millisecond}
+	done := make(chan struct{})
+	go func() {
+		server.ServeHTTP(w, req)
+		close(done)
+	}()
+	for server.ClientCount() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// The hub blocks on the full buffer while the handler's write times out
+	server.Publish([]byte("stall"), "all")
+	go func() {
+		for i := 0; i < 3; i++ {
+			server.Publish([]byte("queued"), "all")
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("eviction deadlocked with the blocked hub")
+	}
+	if n := server.ClientCount(); n != 0 {
+		t.Errorf("expected the client evicted, got %d", n)
+	}
+}
+
+func TestPublishLatest(t *testing.T) {
+	server := New(&Config{}).Server(&ServerConfig{HistoryReplayBuffer: 10})
+	client := &clientConnection{id: "s", channels: []string{"prices"}, send: make(chan []byte, 10), done: make(chan struct{})}
+	server.hub.register <- registerRequest{client: client}
+
+	server.PublishLatest("AAPL", []byte("100"), "prices")
+	server.PublishN([]byte("news"), "prices")
+	server.PublishLatest("AAPL", []byte("101"), "prices")
+	server.PublishLatest("AAPL", []byte("102"), "prices")
+	server.ClientCount() // barrier: dispatched
+
+	// Stale prices stay queued, in order, and are skipped when written
+	var got []string
+	for len(client.send) > 0 {
+		if frame := <-client.send; !client.latest.superseded(frame) {
+			got = append(got, string(frame))
+		}
+	}
+	if len(got) != 2 || !Contains(got[0], "data: news\n") || !Contains(got[1], "data: 102\n") {
+		t.Errorf("expected stale prices replaced, got %q", got)
+	}
+	if len(client.latest.newest) != 0 || len(client.latest.keys) != 0 {
+		t.Error("expected written frames to be forgotten")
+	}
+
+	// Already delivered: the next value is queued normally
+	server.PublishLatest("AAPL", []byte("103"), "prices")
+	if got := string(<-client.send); !Contains(got, "data: 103\n") {
+		t.Errorf("expected new price, got %q", got)
+	}
+
+	replay := &clientConnection{id: "r", channels: []string{"prices"}, send: make(chan []byte, 10), done: make(chan struct{})}
+	server.hub.register <- registerRequest{client: replay, lastEventID: "1"}
+	server.ClientCount()
+	got = nil
+	for len(replay.send) > 0 {
+		got = append(got, string(<-replay.send))
+	}
+	if len(got) != 2 || !Contains(got[0], "data: news\n") || !Contains(got[1], "data: 103\n") {
+		t.Errorf("expected latest-wins replay, got %q", got)
+	}
+	if snap := server.HistorySnapshot([]string{"prices"}, 0); len(snap) != 2 {
+		t.Errorf("expected latest-wins snapshot, got %d messages", len(snap))
+	}
+}
+
+func TestPublishLatestDropOldest(t *testing.T) {
+	server := New(&Config{}).Server(&ServerConfig{
+		ClientChannelBuffer: 1,
+		BackpressurePolicy:  DropOldest,
+	})
+	client := &clientConnection{id: "s", channels: []string{"prices"}, send: make(chan []byte, 1), done: make(chan struct{})}
+	server.hub.register <- registerRequest{client: client}
+
+	for i := 0; i < 50; i++ {
+		server.PublishLatest(Convert(i).String(), []byte("price"), "prices")
+	}
+	server.hub.do(func() {
+		if n := len(client.latest.keys); n != 1 {
+			t.Errorf("expected only the buffered frame tracked, got %d", n)
+		}
+	})
+}
+
+func TestResponseHeaders(t *testing.T) {
+	server := New(&Config{}).Server(&ServerConfig{
+		ChannelProvider: &mockChannelProvider{channels: []string{"all"}},
+		ResponseHeaders: map[string]string{
+			"Cache-Control": "no-store",
+			"X-Region":      "eu",
+		},
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, "GET", "/", nil)
+	w := httptest.NewRecorder()
+	cancel() // Headers are written before the stream loop
+	server.ServeHTTP(w, req)
+
+	for key, want := range map[string]string{
+		"X-Accel-Buffering": "no",
+		"Cache-Control":     "no-store",
+		"X-Region":          "eu",
+	} {
+		if got := w.Header().Get(key); got != want {
+			t.Errorf("expected %s %q, got %q", key, want, got)
+		}
+	}
+
+	server.config.ResponseHeaders = map[string]string{"X-Accel-Buffering": ""}
+	w = httptest.NewRecorder()
+	server.ServeHTTP(w, req)
+	if _, ok := w.Header()["X-Accel-Buffering"]; ok {
+		t.Error("expected empty value to remove the default header")
+	}
+}
+
+func TestResetHistory(t *testing.T) {
+	server := New(&Config{}).Server(&ServerConfig{HistoryReplayBuffer: 10})
+	server.PublishN([]byte("old1"), "feed")
+	server.PublishN([]byte("old2"), "feed")
+
+	server.ResetHistory()
+	if got := server.LastID(); got != 2 {
+		t.Errorf("expected sequence kept at 2, got %d", got)
+	}
+	if snap := server.DebugSnapshot(); snap.HistoryLen != 0 {
+		t.Errorf("expected empty history, got %d", snap.HistoryLen)
+	}
+
+	server.PublishN([]byte("new"), "feed")
+	client := &clientConnection{id: "c", channels: []string{"feed"}, send: make(chan []byte, 10), done: make(chan struct{})}
+	server.hub.register <- registerRequest{client: client, lastEventID: "1"}
+	if got := string(<-client.send); got != formatGapEvent("1") {
+		t.Errorf("expected gap event, got %q", got)
+	}
+	if got := string(<-client.send); !Contains(got, "id: 3\n") {
+		t.Errorf("expected new ID 3 without reuse, got %q", got)
+	}
+}
+
+func TestChannelSubscribers(t *testing.T) {
+	server := New(&Config{}).Server(&ServerConfig{})
+	for id, channels := range map[string][]string{
+		"1": {"room:1", "all"},
+		"2": {"room:2", "all"},
+		"3": {"room:1"},
+	} {
+		server.hub.register <- registerRequest{client: &clientConnection{id: id, channels: channels, send: make(chan []byte, 1), done: make(chan struct{})}}
+	}
+
+	for channel, want := range map[string]int{"room:1": 2, "all": 2, "room:*": 3, "room:3": 0} {
+		if got := server.ChannelSubscribers(channel); got != want {
+			t.Errorf("%s: expected %d subscribers, got %d", channel, want, got)
+		}
+	}
+	if server.HasSubscribers("room:3") || !server.HasSubscribers("room:2") {
+		t.Error("unexpected HasSubscribers result")
+	}
+}
+
+func TestPublishFunc(t *testing.T) {
+	server := New(&Config{}).Server(&ServerConfig{HistoryReplayBuffer: 10})
+	calls := 0
+	build := func() []byte {
+		calls++
+		return []byte("report")
+	}
+
+	if server.PublishFunc(build, "reports") || calls != 0 {
+		t.Fatal("payload must not be built without subscribers")
+	}
+	if snap := server.DebugSnapshot(); snap.HistoryLen != 0 {
+		t.Error("skipped message must not be stored in history")
+	}
+
+	client := &clientConnection{id: "c", channels: []string{"reports"}, send: make(chan []byte, 1), done: make(chan struct{})}
+	server.hub.register <- registerRequest{client: client}
+	if !server.PublishFunc(build, "other", "reports") || calls != 1 {
+		t.Fatal("expected payload built and published")
+	}
+	if got := string(<-client.send); !Contains(got, "data: report\n") {
+		t.Errorf("unexpected message %q", got)
+	}
+}
+
+// plainWriter hides the http.Flusher of the recorder, like a middleware
+// wrapper; unwrapWriter exposes it again through Unwrap.
+type plainWriter struct {
+	rec *httptest.ResponseRecorder
+}
+
+func (w *plainWriter) Header() http.Header         { return w.rec.Header() }
+func (w *plainWriter) Write(p []byte) (int, error) { return w.rec.Write(p) }
+func (w *plainWriter) WriteHeader(code int)        { w.rec.WriteHeader(code) }
+
+type unwrapWriter struct{ *plainWriter }
+
+func (w unwrapWriter) Unwrap() http.ResponseWriter { return w.rec }
+
+func TestNoFlusher(t *testing.T) {
+	server := New(&Config{}).Server(&ServerConfig{
+		ChannelProvider: &mockChannelProvider{channels: []string{"all"}},
+	})
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	w := &plainWriter{rec: httptest.NewRecorder()}
+	server.ServeHTTP(w, req)
+	if w.rec.Code != http.StatusInternalServerError || !Contains(w.rec.Body.String(), "http.Flusher") {
+		t.Errorf("expected 500 naming http.Flusher, got %d %q", w.rec.Code, w.rec.Body.String())
+	}
+	if server.ClientCount() != 0 {
+		t.Error("client must not be registered")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	wrapped := unwrapWriter{&plainWriter{rec: httptest.NewRecorder()}}
+	server.ServeHTTP(wrapped, req.WithContext(ctx))
+	if wrapped.rec.Code != http.StatusOK || !wrapped.rec.Flushed {
+		t.Errorf("expected stream through Unwrap, got %d", wrapped.rec.Code)
+	}
+}
+
+func TestMaxMessageSize(t *testing.T) {
+	server := New(&Config{}).Server(&ServerConfig{MaxMessageSize: 4, HistoryReplayBuffer: 10})
+	client := &clientConnection{id: "c", channels: []string{"feed"}, send: make(chan []byte, 10), done: make(chan struct{})}
+	server.hub.register <- registerRequest{client: client}
+
+	if err := server.PublishContext(context.Background(), []byte("too long"), "feed"); err != ErrMessageTooLarge {
+		t.Errorf("expected ErrMessageTooLarge, got %v", err)
+	}
+	if err := server.SendToClient("c", []byte("too long")); err != ErrMessageTooLarge {
+		t.Errorf("expected ErrMessageTooLarge from SendToClient, got %v", err)
+	}
+	if len(client.send) != 0 || server.DebugSnapshot().HistoryLen != 0 {
+		t.Error("oversized message must not be sent or stored")
+	}
+	if err := server.SendToClient("c", []byte("ok")); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	<-client.send
+
+	server.config.TruncateOversized = true
+	server.PublishN([]byte("truncated"), "feed")
+	if got := string(<-client.send); !Contains(got, "data: trun\n") {
+		t.Errorf("expected truncated data, got %q", got)
+	}
+}
+
+func TestMaxReplayMessages(t *testing.T) {
+	server := New(&Config{}).Server(&ServerConfig{HistoryReplayBuffer: 10, MaxReplayMessages: 2})
+	for _, data := range []string{"1", "2", "3", "4", "5"} {
+		server.PublishN([]byte(data), "feed")
+	}
+
+	client := &clientConnection{id: "c", channels: []string{"feed"}, send: make(chan []byte, 10), done: make(chan struct{})}
+	server.hub.register <- registerRequest{client: client, lastEventID: "1"}
+	server.ClientCount()
+
+	want := []string{formatGapEvent("1"), "data: 4\n", "data: 5\n"}
+	if len(client.send) != len(want) {
+		t.Fatalf("expected gap plus 2 newest messages, got %d", len(client.send))
+	}
+	for _, w := range want {
+		if got := string(<-client.send); !Contains(got, w) {
+			t.Errorf("expected %q, got %q", w, got)
+		}
+	}
+
+	// Within the cap: no gap
+	client2 := &clientConnection{id: "d", channels: []string{"feed"}, send: make(chan []byte, 10), done: make(chan struct{})}
+	server.hub.register <- registerRequest{client: client2, lastEventID: "3"}
+	server.ClientCount()
+	if got := string(<-client2.send); !Contains(got, "data: 4\n") {
+		t.Errorf("expected replay without gap, got %q", got)
+	}
+}
+
+func TestPublishWithOptionsEcho(t *testing.T) {
+	server := New(&Config{}).Server(&ServerConfig{})
+	tab1 := &clientConnection{id: "t1", userID: "ana", channels: []string{"chat"}, send: make(chan []byte, 10), done: make(chan struct{})}
+	tab2 := &clientConnection{id: "t2", userID: "ana", channels: []string{"chat"}, send: make(chan []byte, 10), done: make(chan struct{})}
+	other := &clientConnection{id: "o", userID: "bob", channels: []string{"chat"}, send: make(chan []byte, 10), done: make(chan struct{})}
+	for _, c := range []*clientConnection{tab1, tab2, other} {
+		server.hub.register <- registerRequest{client: c}
+	}
+
+	if err := server.PublishWithOptions(PublishOptions{Event: "chat", SenderID: "t1"}, []byte("hi"), "chat"); err != nil {
+		t.Fatal(err)
+	}
+	if len(tab1.send) != 0 || len(tab2.send) != 1 || len(other.send) != 1 {
+		t.Errorf("expected sender skipped, got %d/%d/%d", len(tab1.send), len(tab2.send), len(other.send))
+	}
+
+	server.PublishWithOptions(PublishOptions{UserID: "ana", SenderID: "t1", EchoToSender: true}, []byte("sync"))
+	if len(tab1.send) != 1 || len(tab2.send) != 2 || len(other.send) != 1 {
+		t.Errorf("expected echo to every tab of the user only, got %d/%d/%d", len(tab1.send), len(tab2.send), len(other.send))
+	}
+
+	if err := server.PublishWithOptions(PublishOptions{SenderID: "ghost"}, []byte("x"), "chat"); err != ErrClientNotFound {
+		t.Errorf("expected ErrClientNotFound, got %v", err)
+	}
+}
+
+func TestNoRegistrationAfterEarlyDisconnect(t *testing.T) {
+	metrics := &mockMetrics{}
+	server := New(&Config{}).Server(&ServerConfig{
+		ChannelProvider: &mockChannelProvider{channels: []string{"all"}},
+		Metrics:         metrics,
+	})
+
+	// The client went away while the headers were being written
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", "/", nil)
+	server.ServeHTTP(httptest.NewRecorder(), req)
+
+	if server.ClientCount() != 0 || metrics.active != 0 {
+		t.Error("client must never be registered")
+	}
+	if snap := server.DebugSnapshot(); snap.Clients != 0 {
+		t.Errorf("expected no clients, got %d", snap.Clients)
+	}
+	server.hub.do(func() {
+		if server.hub.lastClientID.Load() != 0 {
+			t.Error("no client ID should be assigned")
+		}
+	})
+}
+
+func TestConcurrentPublishOrdering(t *testing.T) {
+	const publishers, perPublisher = 8, 200
+	server := New(&Config{}).Server(&ServerConfig{
+		ClientChannelBuffer: publishers * perPublisher,
+	})
+	clients := make([]*clientConnection, 4)
+	for i := range clients {
+		clients[i] = &clientConnection{id: Convert(i).String(), channels: []string{"all"}, send: make(chan []byte, publishers*perPublisher)}
+		server.hub.register <- registerRequest{client: clients[i]}
+	}
+
+	var wg sync.WaitGroup
+	for p := 0; p < publishers; p++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < perPublisher; i++ {
+				server.Publish([]byte("x"), "all")
+			}
+		}()
+	}
+	wg.Wait()
+	server.ClientCount()
+
+	for _, client := range clients {
+		if n := len(client.send); n != publishers*perPublisher {
+			t.Fatalf("client %s: expected %d messages, got %d", client.id, publishers*perPublisher, n)
+		}
+		last := 0
+		for len(client.send) > 0 {
+			id, _ := Convert(eventID(string(<-client.send))).Int()
+			if id <= last {
+				t.Fatalf("client %s: ID %d received after %d", client.id, id, last)
+			}
+			last = id
+		}
+	}
+}
+
+func TestAddTestClient(t *testing.T) {
+	server := NewTestServer(nil)
+	messages := server.AddTestClient("t1", []string{"news"})
+
+	server.PublishEvent("update", []byte("line1\nline2"), "news")
+	server.Publish([]byte("elsewhere"), "sports")
+	server.Publish([]byte("second"), "news")
+
+	first := <-messages
+	if first.ID != "1" || first.Event != "update" || string(first.Data) != "line1\nline2" {
+		t.Errorf("unexpected first message: %+v", first)
+	}
+	if second := <-messages; string(second.Data) != "second" {
+		t.Errorf("unexpected second message: %+v", second)
+	}
+
+	server.Disconnect("t1")
+	if _, ok := <-messages; ok {
+		t.Error("expected the channel to close on Disconnect")
+	}
+
+	// No ID: one is generated, so the client can be targeted
+	anonymous := server.AddTestClient("", []string{"news"})
+	if err := server.SendToClient("1", []byte("direct")); err != nil {
+		t.Fatalf("expected the generated ID 1, got %v", err)
+	}
+	if msg := <-anonymous; string(msg.Data) != "direct" {
+		t.Errorf("unexpected message: %+v", msg)
+	}
+}
+
+func TestLongPollHandler(t *testing.T) {
+	server := New(&Config{}).Server(&ServerConfig{
+		HistoryReplayBuffer: 10,
+		LongPollTimeout:     50 * time.Millisecond,
+		ChannelProvider:     &mockChannelProvider{channels: []string{"all"}},
+	})
+	poll := func(lastEventID string) string {
+		req := httptest.NewRequest("GET", "/poll?lastEventId="+lastEventID, nil)
+		w := httptest.NewRecorder()
+		server.LongPollHandler().ServeHTTP(w, req)
+		if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "text/event-stream" {
+			t.Errorf("unexpected response: %d %q", w.Code, w.Header().Get("Content-Type"))
+		}
+		return w.Body.String()
+	}
+
+	server.PublishN([]byte("one"), "all")
+	server.PublishN([]byte("two"), "all")
+
+	// Missed messages are answered right away
+	if got := poll("1"); got != "id: 2\ndata: two\n\n" {
+		t.Errorf("expected backlog, got %q", got)
+	}
+
+	// Up to date: waits for the next message
+	done := make(chan string)
+	go func() { done <- poll("2") }()
+	waiting := func() (n int) {
+		server.hub.do(func() { n = len(server.hub.pollers) })
+		return n
+	}
+	for waiting() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	server.PublishN([]byte("three"), "all")
+	if got := <-done; got != "id: 3\ndata: three\n\n" {
+		t.Errorf("expected the new message, got %q", got)
+	}
+
+	// Nothing new before the timeout: empty answer
+	if got := poll("3"); got != "" {
+		t.Errorf("expected empty answer, got %q", got)
+	}
+
+	// An unknown ID gets a gap that moves the poller to the last ID
+	if got := poll("unknown"); !HasPrefix(got, "id: 3\n"+formatGapEvent("unknown")) {
+		t.Errorf("expected a gap with the last ID, got %q", got)
+	}
+	if server.ClientCount() != 0 {
+		t.Error("pollers must not count as clients")
+	}
+}
+
+func TestChannelGroups(t *testing.T) {
+	server := New(&Config{}).Server(&ServerConfig{
+		ClientChannelBuffer: 10,
+		ChannelGroups:       map[string][]string{"sports": {"football", "tennis"}},
+		ChannelProvider:     &mockChannelProvider{channels: []string{"sports"}},
+	})
+	fan := &clientConnection{id: "fan", channels: []string{"tennis"}, send: make(chan []byte, 10)}
+	server.hub.register <- registerRequest{client: fan}
+
+	// Publishing to the group reaches member channels
+	if stats := server.PublishN([]byte("match"), "sports"); stats.Delivered != 1 {
+		t.Errorf("expected the group to reach tennis, got %+v", stats)
+	}
+	if !server.HasSubscribers("sports") {
+		t.Error("expected group subscribers to be counted")
+	}
+
+	// Subscribing to the group subscribes to every member
+	stop := connect(server, "/")
+	defer stop()
+	time.Sleep(20 * time.Millisecond)
+	for _, c := range server.Clients() {
+		if c.ID != "fan" && Convert(c.Channels).Join(",").String() != "football,tennis" {
+			t.Errorf("expected group members, got %v", c.Channels)
+		}
+	}
+	server.Subscribe("fan", "sports")
+	server.Unsubscribe("fan", "tennis")
+	if n := server.ChannelSubscribers("football"); n != 2 {
+		t.Errorf("expected 2 football subscribers, got %d", n)
+	}
 }
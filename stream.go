@@ -0,0 +1,73 @@
+//go:build !wasm
+
+package sse
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"time"
+
+	. "github.com/tinywasm/fmt"
+)
+
+// stream writes SSE frames to a connection and flushes each one,
+// gzip-compressing the response when enabled.
+type stream struct {
+	w       io.Writer
+	gz      *gzip.Writer
+	flusher http.Flusher
+
+	// rc sets a write deadline of timeout before each frame, if > 0.
+	rc      *http.ResponseController
+	timeout time.Duration
+}
+
+// newStream sets the compression headers; call it before WriteHeader.
+func newStream(w http.ResponseWriter, flusher http.Flusher, compress bool, timeout time.Duration) *stream {
+	st := &stream{w: w, flusher: flusher, rc: http.NewResponseController(w), timeout: timeout}
+	if compress {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Add("Vary", "Accept-Encoding")
+		st.gz = gzip.NewWriter(w)
+		st.w = st.gz
+	}
+	return st
+}
+
+// write sends a frame and flushes it through gzip and the connection.
+// Past WriteTimeout it fails with an error matching os.ErrDeadlineExceeded.
+func (st *stream) write(frame []byte) error {
+	if st.timeout > 0 {
+		// Ignored if unsupported (http.ErrNotSupported): writes just block
+		st.rc.SetWriteDeadline(time.Now().Add(st.timeout))
+	}
+	if _, err := st.w.Write(frame); err != nil {
+		return err
+	}
+	if st.gz != nil {
+		if err := st.gz.Flush(); err != nil {
+			return err
+		}
+	}
+	st.flusher.Flush()
+	return nil
+}
+
+// flush sends buffered output (e.g., the response headers) and reports a
+// failed write, which http.Flusher alone can't.
+func (st *stream) flush() error {
+	return st.rc.Flush()
+}
+
+// close ends the gzip stream, if any.
+func (st *stream) close() {
+	if st.gz != nil {
+		st.gz.Close()
+	}
+}
+
+// acceptsGzip reports whether the client accepts a gzip response.
+func acceptsGzip(r *http.Request) bool {
+	return Contains(r.Header.Get("Accept-Encoding"), "gzip")
+}
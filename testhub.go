@@ -0,0 +1,97 @@
+//go:build !wasm
+
+package sse
+
+import (
+	"bytes"
+	"encoding/base64"
+	"time"
+
+	. "github.com/tinywasm/fmt"
+)
+
+// NewTestServer returns an SSEServer for unit tests of publishing logic:
+// pair it with AddTestClient to receive messages without HTTP. A nil
+// config uses the defaults. Without GenerateClientID, client IDs are
+// "1", "2", ... instead of random, so tests can predict them.
+func NewTestServer(c *ServerConfig) *SSEServer {
+	if c == nil {
+		c = &ServerConfig{}
+	}
+	s := New(&Config{}).Server(c)
+	s.hub.counterIDs = true
+	return s
+}
+
+// AddTestClient registers an in-memory client subscribed to channels and
+// returns the messages it receives, decoded, in order. Heartbeats and
+// other comments are skipped. The channel is closed when the client is
+// removed (Disconnect, Shutdown...). Meant for tests: the returned channel
+// must be drained, as a full one backs up like a slow client. An empty ID
+// is generated as for HTTP clients ("1", "2", ... with NewTestServer),
+// and one already in use is replaced by a generated one, as with
+// AcceptClientID.
+func (s *SSEServer) AddTestClient(id string, channels []string) <-chan SSEMessage {
+	client := &clientConnection{
+		id:       id,
+		channels: channels,
+		send:     make(chan []byte, s.config.ClientChannelBuffer),
+		done:     make(chan struct{}),
+	}
+	out := make(chan SSEMessage, s.config.ClientChannelBuffer)
+	assigned := make(chan registered, 1)
+	go func() {
+		defer close(out)
+		defer client.closeDone()
+		emit := func(frame []byte) {
+			if client.latest.superseded(frame) {
+				return
+			}
+			if msg, ok := parseFrame(frame, s.tinySSE.config.BinaryEncoding); ok {
+				out <- msg
+			}
+		}
+		for _, frame := range (<-assigned).replay {
+			emit(frame)
+		}
+		for frame := range client.send {
+			emit(frame)
+		}
+	}()
+	s.hub.register <- registerRequest{client: client, suggestedID: id != "", assigned: assigned}
+	return out
+}
+
+// parseFrame decodes a frame written by formatSSEMessage. ok is false for
+// frames without data, such as comments.
+func parseFrame(frame []byte, binary bool) (msg SSEMessage, ok bool) {
+	var data [][]byte
+	for _, line := range bytes.Split(frame, []byte("\n")) {
+		field, value, found := bytes.Cut(line, []byte(": "))
+		if !found {
+			field, value = line, nil
+		}
+		switch string(field) {
+		case "id":
+			msg.ID = string(value)
+		case "event":
+			msg.Event = string(value)
+		case "data":
+			data = append(data, value)
+			ok = true
+		case "retry":
+			msg.Retry, _ = Convert(string(value)).Int()
+		case "time":
+			if ms, err := Convert(string(value)).Int64(); err == nil {
+				msg.Timestamp = time.UnixMilli(ms)
+			}
+		}
+	}
+	msg.Data = bytes.Join(data, []byte("\n"))
+	if binary {
+		if decoded, err := base64.StdEncoding.DecodeString(string(msg.Data)); err == nil {
+			msg.Data = decoded
+		}
+	}
+	return msg, ok
+}
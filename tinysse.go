@@ -10,9 +10,36 @@ func New(c *Config) *tinySSE {
 	return &tinySSE{config: c}
 }
 
-// log prints to the configured logger if one is set.
-func (t *tinySSE) log(args ...any) {
-	if t.config.Log != nil {
+// debug, info, warn and error log through Config.Logger at that level,
+// or through Config.Log if no Logger is set. Both nil = no-op.
+func (t *tinySSE) debug(args ...any) {
+	if t.config.Logger != nil {
+		t.config.Logger.Debug(args...)
+	} else if t.config.Log != nil {
+		t.config.Log(args...)
+	}
+}
+
+func (t *tinySSE) info(args ...any) {
+	if t.config.Logger != nil {
+		t.config.Logger.Info(args...)
+	} else if t.config.Log != nil {
+		t.config.Log(args...)
+	}
+}
+
+func (t *tinySSE) warn(args ...any) {
+	if t.config.Logger != nil {
+		t.config.Logger.Warn(args...)
+	} else if t.config.Log != nil {
+		t.config.Log(args...)
+	}
+}
+
+func (t *tinySSE) error(args ...any) {
+	if t.config.Logger != nil {
+		t.config.Logger.Error(args...)
+	} else if t.config.Log != nil {
 		t.config.Log(args...)
 	}
 }